@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
+)
+
+// agentRequest is the payload posted to sql-agent.
+type agentRequest struct {
+	Driver     string                 `json:"driver"`
+	Connection map[string]interface{} `json:"connection"`
+	SQL        string                 `json:"sql"`
+	Params     map[string]interface{} `json:"params"`
+}
+
+// mockAgent implements the sql-agent protocol. Each request is answered with
+// the records of the fixture for its SQL, unknown statements fail.
+type mockAgent struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	fixtures map[string][]map[string]interface{}
+	requests []agentRequest
+}
+
+// newMockAgent starts an agent serving the fixtures file, a JSON object of
+// records by SQL statement. Close the agent when done.
+func newMockAgent(t *testing.T, fixtures string) *mockAgent {
+	b, err := ioutil.ReadFile(fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &mockAgent{}
+	if err := json.Unmarshal(b, &a.fixtures); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Server = httptest.NewServer(http.HandlerFunc(a.serve))
+	return a
+}
+
+func (a *mockAgent) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.Header.Get("content-type") != "application/json" {
+		http.Error(w, "Expected a POST of JSON", http.StatusBadRequest)
+		return
+	}
+
+	var req agentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	a.requests = append(a.requests, req)
+	recs, ok := a.fixtures[req.SQL]
+	a.mu.Unlock()
+
+	if !ok {
+		http.Error(w, fmt.Sprintf("No fixture for SQL [%s]", req.SQL), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(recs)
+}
+
+// Requests returns the payloads received so far.
+func (a *mockAgent) Requests() []agentRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]agentRequest(nil), a.requests...)
+}
+
+func TestMockAgentPipeline(t *testing.T) {
+	agent := newMockAgent(t, "test-resources/agent/fixtures.json")
+	defer agent.Close()
+
+	queries, err := loadQueryConfig("test-resources/agent/queries.yml", newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]float64)
+	for _, q := range queries {
+		w, err := NewWorker(context.Background(), q, newConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.unregisterMetrics()
+		if _, err := w.Fetch(agent.URL); err != nil {
+			t.Fatal(err)
+		}
+		for key, g := range w.result.Metrics() {
+			metric := &dto.Metric{}
+			g.Write(metric)
+			got[key] = metric.GetGauge().GetValue()
+		}
+	}
+
+	want := map[string]float64{
+		`sales_total{}`:                     42,
+		`sales_by_country{"country":"swe"}`: 3,
+		`sales_by_country{"country":"usa"}`: 5,
+	}
+	if len(got) != len(want) {
+		t.Errorf("metrics = %v, want %v", got, want)
+	}
+	for key, v := range want {
+		if got[key] != v {
+			t.Errorf("[%s] = %v, want %v", key, got[key], v)
+		}
+	}
+
+	reqs := agent.Requests()
+	if len(reqs) != 2 || reqs[0].Driver != "postgresql" || reqs[0].Connection["host"] != "example.org" {
+		t.Errorf("requests = %+v", reqs)
+	}
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -22,43 +29,444 @@ var (
 	DefaultQueriesFile                  = "queries.yml"
 	DefaultQueriesDir                   = ""
 	DefaultPort                         = 8080
+	DefaultSocket                       = ""
+	DefaultMetricsPath                  = "/metrics"
 	DefaultConfFile                     = ""
 	DefaultTolerateInvalidQueryDirFiles = false
+	DefaultWaitForFirstFetch            = false
+	DefaultStrict                       = false
+	DefaultMaxResponseBytes             = int64(64 << 20)
+	DefaultCheckAgent                   = false
+	DefaultExposeConfig                 = false
+	DefaultShutdownTimeout              = time.Second * 5
+	DefaultCheckAgentTimeout            = time.Second * 10
+	DefaultFirstFetchTimeout            = time.Minute * 5
+	DefaultRecursive                    = false
+	DefaultNoInitialTick                = false
+	DefaultOneshot                      = false
+	DefaultMaxRuntime                   = time.Duration(0)
+	DefaultMaxQueries                   = 0
+	DefaultLabelCase                    = CaseLower
+	DefaultFetchDurationHistogram       = false
+	DefaultQueryGlob                    = "*.yml"
+	DefaultLabelSourceFile              = false
+	DefaultNoDefaultPrefix              = false
+	DefaultTextfileDir                  = ""
 )
 
 // Config is the base data structure.
 type Config struct {
 	Defaults    DefaultsData          `yaml:"defaults"`
 	DataSources map[string]DataSource `yaml:"data-sources"`
+	UserAgent   string                `yaml:"user-agent"`
+	// AgentProtocol forces the HTTP protocol used to talk to sql-agent,
+	// http1 or http2. By default it is negotiated.
+	AgentProtocol string `yaml:"agent-protocol"`
+	// ProxyURL is the HTTP proxy to reach sql-agent through. By default the
+	// HTTP_PROXY and HTTPS_PROXY environment variables are used.
+	ProxyURL string `yaml:"proxy-url"`
+	// PayloadTemplate reshapes the request body sent to sql-agent, a Go
+	// template over the fields of the default body.
+	PayloadTemplate string `yaml:"payload-template"`
+
+	// Strict turns configuration warnings into errors.
+	Strict bool `yaml:"-"`
+	// MaxResponseBytes limits the size of sql-agent responses, zero means
+	// no limit.
+	MaxResponseBytes int64 `yaml:"-"`
+	// Recursive loads query files in subdirectories of query directories.
+	Recursive bool `yaml:"-"`
+	// QueryGlob selects the files loaded from query directories.
+	QueryGlob string `yaml:"-"`
+	// LabelSourceFile labels query metrics with the file of the query.
+	LabelSourceFile bool `yaml:"-"`
+	// NoDefaultPrefix names query metrics by the query alone instead of
+	// prefixing query_result_.
+	NoDefaultPrefix bool `yaml:"-"`
+	// NoInitialTick delays the first fetch of each query by its interval.
+	NoInitialTick bool `yaml:"-"`
+	// LabelCase is the case of facet label names and values, lower by
+	// default.
+	LabelCase string `yaml:"-"`
+	// FetchDurationHistogram records fetch durations in a histogram instead
+	// of a gauge of the last fetch.
+	FetchDurationHistogram bool `yaml:"-"`
 }
 
 // DefaultsData defines the possible default values to define.
 type DefaultsData struct {
-	DataSourceRef     string        `yaml:"data-source"`
-	QueryInterval     time.Duration `yaml:"query-interval"`
-	QueryTimeout      time.Duration `yaml:"query-timeout"`
-	QueryValueOnError string        `yaml:"query-value-on-error"`
+	DataSourceRef     string                 `yaml:"data-source"`
+	QueryInterval     time.Duration          `yaml:"query-interval"`
+	QueryTimeout      time.Duration          `yaml:"query-timeout"`
+	QueryValueOnError string                 `yaml:"query-value-on-error"`
+	DefaultParams     map[string]interface{} `yaml:"default-params"`
+	Namespace         string                 `yaml:"namespace"`
+	Subsystem         string                 `yaml:"subsystem"`
+}
+
+// UnmarshalYAML takes bare numbers of the durations as seconds.
+func (d *DefaultsData) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain DefaultsData
+	return unmarshalSeconds(unmarshal, (*plain)(d), "query-interval", "query-timeout")
 }
 
 // DataSource is configuration a data source which must be supported by sql-agent.
 type DataSource struct {
 	Driver     string                 `yaml:"driver"`
 	Properties map[string]interface{} `yaml:"properties"`
+	// DSN is a connection string alternative to the properties, passed to
+	// sql-agent as the dsn property.
+	DSN string `yaml:"dsn,omitempty"`
+	// AcceptHeaders are content negotiation headers sent to sql-agent, the
+	// Accept header or Accept-* headers.
+	AcceptHeaders map[string]string `yaml:"accept-headers,omitempty"`
+
+	// Defaults for queries of the data source, over the global defaults.
+	QueryInterval time.Duration `yaml:"query-interval"`
+	QueryTimeout  time.Duration `yaml:"query-timeout"`
+
+	// secrets are the properties read from files, always redacted.
+	secrets map[string]bool
+}
+
+// UnmarshalYAML takes bare numbers of the durations as seconds.
+func (ds *DataSource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain DataSource
+	return unmarshalSeconds(unmarshal, (*plain)(ds), "query-interval", "query-timeout")
+}
+
+// secretFileSuffix marks a property whose value is read from the file it
+// names, e.g. password_file: /run/secrets/db sets the password.
+const secretFileSuffix = "_file"
+
+// resolveSecretFiles replaces properties ending in secretFileSuffix by the
+// content of their file without trailing newlines.
+func resolveSecretFiles(name string, ds *DataSource) error {
+	for k, v := range ds.Properties {
+		if !strings.HasSuffix(k, secretFileSuffix) {
+			continue
+		}
+		path, ok := v.(string)
+		if !ok {
+			return &DataSourceError{Name: name, Field: k, Reason: "Secret file must be a path"}
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return &DataSourceError{Name: name, Field: k, Reason: fmt.Sprintf("Error reading secret file: %s", err)}
+		}
+
+		key := strings.TrimSuffix(k, secretFileSuffix)
+		delete(ds.Properties, k)
+		ds.Properties[key] = strings.TrimRight(string(b), "\r\n")
+		if ds.secrets == nil {
+			ds.secrets = make(map[string]bool)
+		}
+		ds.secrets[key] = true
+	}
+
+	return nil
 }
 
 // Query defines a SQL statement and parameters as well as configuration for the monitoring behavior
 type Query struct {
-	Name          string
-	DataSourceRef string `yaml:"data-source"`
-	Driver        string
-	Connection    map[string]interface{}
-	SQL           string
-	Params        map[string]interface{}
-	Interval      time.Duration
-	Timeout       time.Duration
-	DataField     string            `yaml:"data-field"`
-	SubMetrics    map[string]string `yaml:"sub-metrics"`
-	ValueOnError  string            `yaml:"value-on-error"`
+	Name            string
+	DataSourceRef   string   `yaml:"data-source"`
+	DataSourceRefs  []string `yaml:"data-sources"`
+	FallbackRefs    []string `yaml:"fallback-data-sources,omitempty"`
+	Driver          string
+	Connection      map[string]interface{}
+	SQL             string
+	Params          map[string]interface{}
+	ReadOnly        bool   `yaml:"read-only"`
+	Isolation       string `yaml:"isolation"`
+	Interval        time.Duration
+	IntervalJitter  float64 `yaml:"interval-jitter"`
+	Timeout         time.Duration
+	DataField       string                     `yaml:"data-field"`
+	ValueColumn     *int                       `yaml:"value-column-index"`
+	SubMetrics      map[string]SubMetric       `yaml:"sub-metrics"`
+	SubMetricsLabel string                     `yaml:"sub-metrics-as-label"`
+	ValueColumns    []string                   `yaml:"value-columns"`
+	Columns         map[string]string          `yaml:"columns"`
+	SkipZero        bool                       `yaml:"skip-zero"`
+	ValueAsLabel    bool                       `yaml:"value-as-label"`
+	StaleAfter      time.Duration              `yaml:"stale-after"`
+	ProcessTimeout  time.Duration              `yaml:"process-timeout"`
+	ValueOnError    string                     `yaml:"value-on-error"`
+	ErrorField      string                     `yaml:"error-field"`
+	ErrorLabels     map[string]string          `yaml:"error-labels"`
+	MinFetchGap     time.Duration              `yaml:"min-fetch-gap"`
+	TimestampField  string                     `yaml:"timestamp-field"`
+	TimestampFormat string                     `yaml:"timestamp-format"`
+	MaxSeries       int                        `yaml:"max-series"`
+	Labels          map[string]string          `yaml:"labels"`
+	ParamsAsLabels  []string                   `yaml:"params-as-labels"`
+	UnitParse       string                     `yaml:"unit-parse"`
+	DecimalSep      string                     `yaml:"decimal-separator"`
+	Scale           *float64                   `yaml:"scale"`
+	Offset          float64                    `yaml:"offset"`
+	Round           *int                       `yaml:"round"`
+	Filter          string                     `yaml:"filter"`
+	Expression      string                     `yaml:"expression"`
+	BackoffReset    string                     `yaml:"backoff-reset"`
+	CircuitFailures int                        `yaml:"circuit-breaker-failures"`
+	CircuitCooldown time.Duration              `yaml:"circuit-breaker-cooldown"`
+	FastInterval    time.Duration              `yaml:"fast-interval"`
+	SlowInterval    time.Duration              `yaml:"slow-interval"`
+	ThresholdColumn string                     `yaml:"threshold-column"`
+	Threshold       float64                    `yaml:"threshold"`
+	LabelTransforms map[string]*LabelTransform `yaml:"label-transforms"`
+	InfoMetric      bool                       `yaml:"info-metric"`
+	Warmup          bool                       `yaml:"warmup"`
+	Namespace       string                     `yaml:"namespace"`
+	Subsystem       string                     `yaml:"subsystem"`
+
+	// fallbacks are the resolved data sources of FallbackRefs.
+	fallbacks []DataSource
+	// filter is the compiled Filter.
+	filter *rowFilter
+	// expr is the compiled Expression.
+	expr *exprNode
+	// sourceFile is the queries file the query was loaded from.
+	sourceFile string
+	// acceptHeaders are the accept headers of the data source.
+	acceptHeaders map[string]string
+}
+
+// queryDurations are the keys of the durations of a query.
+var queryDurations = []string{
+	"interval", "timeout", "stale-after", "process-timeout", "min-fetch-gap",
+	"circuit-breaker-cooldown", "fast-interval", "slow-interval",
+}
+
+// UnmarshalYAML accepts a list for data-source, the first data source is
+// used and the others are fallbacks tried in order when it fails. Bare
+// numbers of the durations are taken as seconds.
+func (q *Query) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Query
+
+	var fields yaml.MapSlice
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	seconds := secondsDurations(fields, queryDurations...)
+
+	var (
+		refs  []string
+		found bool
+	)
+	for i, f := range fields {
+		list, ok := f.Value.([]interface{})
+		if f.Key != "data-source" || !ok {
+			continue
+		}
+		for _, v := range list {
+			refs = append(refs, fmt.Sprintf("%v", v))
+		}
+		fields = append(fields[:i], fields[i+1:]...)
+		found = true
+		break
+	}
+	if !found && !seconds {
+		return unmarshal((*plain)(q))
+	}
+
+	b, err := yaml.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(b, (*plain)(q)); err != nil {
+		return err
+	}
+	if len(refs) > 0 {
+		q.DataSourceRef = refs[0]
+		q.FallbackRefs = refs[1:]
+	}
+	return nil
+}
+
+// unmarshalSeconds unmarshals into v, taking bare numbers of the duration
+// keys as seconds.
+func unmarshalSeconds(unmarshal func(interface{}) error, v interface{}, keys ...string) error {
+	var fields yaml.MapSlice
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	if !secondsDurations(fields, keys...) {
+		return unmarshal(v)
+	}
+
+	b, err := yaml.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(b, v)
+}
+
+// secondsDurations replaces bare numbers of the duration keys by durations
+// in seconds. Otherwise yaml decodes interval: 30 as 30ns. It reports
+// whether a value was replaced.
+func secondsDurations(fields yaml.MapSlice, keys ...string) bool {
+	replaced := false
+	for i, f := range fields {
+		key, ok := f.Key.(string)
+		if ok {
+			ok = false
+			for _, k := range keys {
+				ok = ok || k == key
+			}
+		}
+		if !ok {
+			continue
+		}
+		var d time.Duration
+		switch v := f.Value.(type) {
+		case int:
+			d = time.Duration(v) * time.Second
+		case float64:
+			d = time.Duration(v * float64(time.Second))
+		default:
+			continue
+		}
+		log.Printf("Deprecated: %s: %v without a unit is taken as seconds, use %s", key, f.Value, d)
+		fields[i].Value = d.String()
+		replaced = true
+	}
+	return replaced
+}
+
+// LabelTransform normalizes the value of a facet column before it becomes a
+// label. The value is trimmed, then the regex replaced and finally the case
+// transformed.
+type LabelTransform struct {
+	Trim        bool   `yaml:"trim"`
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+	Case        string `yaml:"case"`
+
+	re *regexp.Regexp
+}
+
+// Supported case transforms of a label value.
+const (
+	CaseLower    = "lower"
+	CaseUpper    = "upper"
+	CasePreserve = "preserve"
+)
+
+// applyCase transforms the case of a label name or value, lowercasing it
+// unless another case is given.
+func applyCase(v, c string) string {
+	switch c {
+	case CaseUpper:
+		return strings.ToUpper(v)
+	case CasePreserve:
+		return v
+	}
+	return strings.ToLower(v)
+}
+
+// Apply transforms a label value. Without a case of the transform, the
+// default case is applied.
+func (t *LabelTransform) Apply(v, defaultCase string) string {
+	if t.Trim {
+		v = strings.TrimSpace(v)
+	}
+	if t.re != nil {
+		v = t.re.ReplaceAllString(v, t.Replacement)
+	}
+	if t.Case == "" {
+		return applyCase(v, defaultCase)
+	}
+	return applyCase(v, t.Case)
+}
+
+// DataSourceLabel is the label identifying the data source of a query that
+// was expanded from a list of data sources.
+const DataSourceLabel = "data_source"
+
+// Roles of a column in the columns mapping of a query.
+const (
+	ColumnLabel = "label"
+	ColumnValue = "value"
+)
+
+// SourceFileLabel is the label holding the queries file of a query, with
+// -label-source-file.
+const SourceFileLabel = "file"
+
+// Supported isolation levels of a query, sent to sql-agent as a hint.
+const (
+	IsolationReadUncommitted = "read-uncommitted"
+	IsolationReadCommitted   = "read-committed"
+	IsolationRepeatableRead  = "repeatable-read"
+	IsolationSnapshot        = "snapshot"
+	IsolationSerializable    = "serializable"
+)
+
+// DefaultErrorField is the column of the value-on-error in the record set
+// after a failed fetch.
+const DefaultErrorField = "error"
+
+// errorField returns the column of the value-on-error of the query.
+func (q *Query) errorField() string {
+	if q.ErrorField != "" {
+		return q.ErrorField
+	}
+	return DefaultErrorField
+}
+
+// Supported formats of a query's timestamp-field.
+const (
+	TimestampFormatRFC3339 = "rfc3339"
+	TimestampFormatUnix    = "unix"
+)
+
+// SubMetric defines the column holding a sub-metric's value and optionally
+// its own help text and extra constant labels.
+type SubMetric struct {
+	Column     string            `yaml:"column"`
+	Help       string            `yaml:"help"`
+	Labels     map[string]string `yaml:"labels"`
+	UnitParse  string            `yaml:"unit-parse"`
+	Expression string            `yaml:"expression"`
+	Round      *int              `yaml:"round"`
+
+	expr *exprNode
+}
+
+// Supported unit-parse modes for string values with units.
+const (
+	UnitParseBytes    = "bytes"
+	UnitParseDuration = "duration"
+)
+
+// Supported decimal separators of numbers given as strings. With a comma
+// the dot is taken as the grouping separator, e.g. "1.234,56".
+const (
+	DecimalSeparatorDot   = "."
+	DecimalSeparatorComma = ","
+)
+
+// Supported strategies to reset the backoff after a successful fetch. A soft
+// reset steps the backoff back by one attempt, halving the wait with the
+// default factor, so it keeps ramping up against a flapping agent.
+const (
+	BackoffResetFull = "full"
+	BackoffResetSoft = "soft"
+)
+
+// UnmarshalYAML supports both the simple `suffix: column` form and the
+// extended object form of a sub-metric.
+func (s *SubMetric) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var column string
+	if err := unmarshal(&column); err == nil {
+		*s = SubMetric{Column: column}
+		return nil
+	}
+
+	type plain SubMetric
+	return unmarshal((*plain)(s))
 }
 
 // QueryList is a array or Queries
@@ -67,53 +475,373 @@ type QueryList []*Query
 func createDefaultsData() DefaultsData {
 	return DefaultsData{
 		DataSourceRef:     "",
-		QueryInterval:     DefaultInterval,
-		QueryTimeout:      DefaultTimeout,
+		QueryInterval:     envDuration(EnvDefaultInterval, DefaultInterval),
+		QueryTimeout:      envDuration(EnvDefaultTimeout, DefaultTimeout),
 		QueryValueOnError: "",
 	}
 }
 
+// Environment variables overriding the built-in default interval and
+// timeout, but not those of the config file.
+const (
+	EnvDefaultInterval = "PROMSQL_DEFAULT_INTERVAL"
+	EnvDefaultTimeout  = "PROMSQL_DEFAULT_TIMEOUT"
+)
+
+// envDuration returns the duration of an environment variable, or def if it
+// is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Ignoring invalid %s [%s], using %s", name, v, def)
+		return def
+	}
+	return d
+}
+
 func newConfig() *Config {
 	return &Config{Defaults: createDefaultsData()}
 }
 
 func appendDefaults(c *Config) {
 	if c.Defaults.QueryInterval == 0 {
-		c.Defaults.QueryInterval = DefaultInterval
+		c.Defaults.QueryInterval = envDuration(EnvDefaultInterval, DefaultInterval)
 	}
 	if c.Defaults.QueryTimeout == 0 {
-		c.Defaults.QueryTimeout = DefaultTimeout
+		c.Defaults.QueryTimeout = envDuration(EnvDefaultTimeout, DefaultTimeout)
+	}
+}
+
+// ValidationError is returned when a query definition is invalid. Field
+// names the offending query option.
+type ValidationError struct {
+	Query  string
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Query == "" {
+		return e.Reason
 	}
+	return fmt.Sprintf("%s for query [%s]", e.Reason, e.Query)
+}
+
+// DataSourceError is returned when a data source definition is invalid.
+// Field names the offending data source option.
+type DataSourceError struct {
+	Name   string
+	Field  string
+	Reason string
+}
+
+func (e *DataSourceError) Error() string {
+	return fmt.Sprintf("%s for data source [%s]", e.Reason, e.Name)
+}
+
+// ConfigError is returned when a top-level option of the config file is
+// invalid. Field names the offending option.
+type ConfigError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return e.Reason
 }
 
+// Supported protocols to talk to sql-agent.
+const (
+	AgentProtocolHTTP1 = "http1"
+	AgentProtocolHTTP2 = "http2"
+)
+
 func validateConfig(c *Config) error {
+	switch c.AgentProtocol {
+	case "", AgentProtocolHTTP1, AgentProtocolHTTP2:
+	default:
+		return &ConfigError{Field: "agent-protocol", Reason: fmt.Sprintf("Unsupported agent-protocol [%s]", c.AgentProtocol)}
+	}
+	if c.PayloadTemplate != "" {
+		if _, err := newPayloadTemplate(c.PayloadTemplate); err != nil {
+			return &ConfigError{Field: "payload-template", Reason: fmt.Sprintf("Invalid payload-template: %s", err)}
+		}
+	}
+	if c.ProxyURL != "" {
+		if u, err := url.Parse(c.ProxyURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return &ConfigError{Field: "proxy-url", Reason: fmt.Sprintf("Invalid proxy-url [%s]", c.ProxyURL)}
+		}
+	}
 	for name, ds := range c.DataSources {
 		if ds.Driver == "" {
-			return fmt.Errorf("Driver is not defined for data source [%s]", name)
+			return &DataSourceError{Name: name, Field: "driver", Reason: "Driver is not defined"}
+		}
+		if len(ds.Properties) == 0 && ds.DSN == "" {
+			return &DataSourceError{Name: name, Field: "properties", Reason: "Properties or dsn are not defined"}
 		}
-		if len(ds.Properties) == 0 {
-			return fmt.Errorf("Properties are not defined for data source [%s]", name)
+		for h := range ds.AcceptHeaders {
+			if c := http.CanonicalHeaderKey(h); c != "Accept" && !strings.HasPrefix(c, "Accept-") {
+				return &DataSourceError{Name: name, Field: "accept-headers", Reason: fmt.Sprintf("Header [%s] is not an Accept header", h)}
+			}
 		}
 	}
 
 	return nil
 }
 
-func validateQuery(q *Query) error {
+func validUnitParse(unit string) bool {
+	switch unit {
+	case "", UnitParseBytes, UnitParseDuration:
+		return true
+	}
+	return false
+}
+
+// validateSubMetricsLabel checks that the sub-metrics of a query can share
+// one metric, told apart by the sub-metrics-as-label label.
+func validateSubMetricsLabel(q *Query) error {
+	label := q.SubMetricsLabel
+	if !metricNamePattern.MatchString(label) {
+		return &ValidationError{Query: q.Name, Field: "sub-metrics-as-label", Reason: fmt.Sprintf("Invalid label name [%s]", label)}
+	}
+	if _, ok := q.Labels[label]; ok {
+		return &ValidationError{Query: q.Name, Field: "sub-metrics-as-label", Reason: fmt.Sprintf("Label [%s] is already a label of the query", label)}
+	}
+	if len(q.SubMetrics) == 0 && len(q.ValueColumns) == 0 {
+		return &ValidationError{Query: q.Name, Field: "sub-metrics-as-label", Reason: "sub-metrics-as-label requires sub-metrics or value-columns"}
+	}
+
+	// Series of one metric must have the same help and label names.
+	var first *SubMetric
+	for suffix, sm := range q.SubMetrics {
+		sm := sm
+		if first == nil {
+			first = &sm
+			continue
+		}
+		if sm.Help != first.Help || !sameKeys(sm.Labels, first.Labels) {
+			return &ValidationError{Query: q.Name, Field: "sub-metrics-as-label", Reason: fmt.Sprintf("Sub-metric [%s] differs in help or label names from the other sub-metrics", suffix)}
+		}
+	}
+	return nil
+}
+
+// sameKeys reports whether two label maps have the same keys.
+func sameKeys(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// metricNamePattern matches valid parts of metric names.
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func validateQuery(q *Query, strict bool) error {
 	if q.Name == "" {
-		return errors.New("Query is not named")
+		return &ValidationError{Field: "name", Reason: "Query is not named"}
 	}
 	if q.Driver == "" {
-		return fmt.Errorf("No data source or driver is specified for query [%s]", q.Name)
+		return &ValidationError{Query: q.Name, Field: "driver", Reason: "No data source or driver is specified"}
 	}
 	if q.SQL == "" {
-		return fmt.Errorf("SQL statement required for query [%s]", q.Name)
+		return &ValidationError{Query: q.Name, Field: "sql", Reason: "SQL statement required"}
 	}
 	if q.Timeout == 0 {
-		return fmt.Errorf("Timeout must be greater than zero for query [%s]", q.Name)
+		return &ValidationError{Query: q.Name, Field: "timeout", Reason: "Timeout must be greater than zero"}
 	}
 	if q.Interval == 0 {
-		return fmt.Errorf("Interval must be greater than zero for query [%s]", q.Name)
+		return &ValidationError{Query: q.Name, Field: "interval", Reason: "Interval must be greater than zero"}
+	}
+	if q.Timeout >= q.Interval {
+		reason := fmt.Sprintf("Timeout (%s) should be shorter than interval (%s)", q.Timeout, q.Interval)
+		if strict {
+			return &ValidationError{Query: q.Name, Field: "timeout", Reason: reason}
+		}
+		log.Printf("Warning: %s for query [%s]", reason, q.Name)
+	}
+	for field, v := range map[string]string{"namespace": q.Namespace, "subsystem": q.Subsystem} {
+		if v != "" && !metricNamePattern.MatchString(v) {
+			return &ValidationError{Query: q.Name, Field: field, Reason: fmt.Sprintf("Invalid %s [%s]", field, v)}
+		}
+	}
+	if q.IntervalJitter < 0 || q.IntervalJitter >= 100 {
+		return &ValidationError{Query: q.Name, Field: "interval-jitter", Reason: "interval-jitter must be a percentage from 0 to below 100"}
+	}
+	if q.DataField != "" && len(q.SubMetrics) > 0 {
+		return &ValidationError{Query: q.Name, Field: "sub-metrics", Reason: "sub-metrics are not compatible with data-field"}
+	}
+	if q.ValueColumn != nil {
+		if q.DataField != "" || len(q.SubMetrics) > 0 {
+			return &ValidationError{Query: q.Name, Field: "value-column-index", Reason: "value-column-index is not compatible with data-field or sub-metrics"}
+		}
+		if *q.ValueColumn < 0 {
+			return &ValidationError{Query: q.Name, Field: "value-column-index", Reason: "value-column-index must not be negative"}
+		}
+	}
+	if len(q.ValueColumns) > 0 {
+		if q.DataField != "" || q.ValueColumn != nil || len(q.SubMetrics) > 0 || q.Expression != "" {
+			return &ValidationError{Query: q.Name, Field: "value-columns", Reason: "value-columns is not compatible with data-field, value-column-index, sub-metrics or expression"}
+		}
+		seen := make(map[string]bool, len(q.ValueColumns))
+		for _, c := range q.ValueColumns {
+			c = strings.ToLower(c)
+			if c == "" {
+				return &ValidationError{Query: q.Name, Field: "value-columns", Reason: "Empty column in value-columns"}
+			}
+			if seen[c] {
+				return &ValidationError{Query: q.Name, Field: "value-columns", Reason: fmt.Sprintf("Duplicate column [%s] in value-columns", c)}
+			}
+			seen[c] = true
+		}
+	}
+	if len(q.Columns) > 0 {
+		if q.DataField != "" || q.ValueColumn != nil || len(q.SubMetrics) > 0 || len(q.ValueColumns) > 0 || q.Expression != "" {
+			return &ValidationError{Query: q.Name, Field: "columns", Reason: "columns is not compatible with data-field, value-column-index, sub-metrics, value-columns or expression"}
+		}
+		values := 0
+		for c, role := range q.Columns {
+			switch role {
+			case ColumnLabel:
+			case ColumnValue:
+				values++
+			default:
+				return &ValidationError{Query: q.Name, Field: "columns", Reason: fmt.Sprintf("Unsupported role [%s] of column [%s]", role, c)}
+			}
+		}
+		if values != 1 {
+			return &ValidationError{Query: q.Name, Field: "columns", Reason: "Exactly one column must be the value"}
+		}
+	}
+	if q.InfoMetric && (len(q.SubMetrics) > 0 || len(q.ValueColumns) > 0) {
+		return &ValidationError{Query: q.Name, Field: "info-metric", Reason: "info-metric is not compatible with sub-metrics or value-columns"}
+	}
+	if q.ValueAsLabel && (len(q.SubMetrics) > 0 || len(q.ValueColumns) > 0 || q.Expression != "" || q.InfoMetric || q.SkipZero) {
+		return &ValidationError{Query: q.Name, Field: "value-as-label", Reason: "value-as-label is not compatible with sub-metrics, value-columns, expression, info-metric or skip-zero"}
+	}
+	// With labels the error record has several columns, so its value must
+	// be the data field.
+	if len(q.ErrorLabels) > 0 && strings.ToLower(q.errorField()) != strings.ToLower(q.DataField) {
+		return &ValidationError{Query: q.Name, Field: "error-labels", Reason: "error-labels require error-field to be the data-field"}
+	}
+	if q.SubMetricsLabel != "" {
+		if err := validateSubMetricsLabel(q); err != nil {
+			return err
+		}
+	}
+	if (q.FastInterval > 0) != (q.ThresholdColumn != "") {
+		return &ValidationError{Query: q.Name, Field: "fast-interval", Reason: "fast-interval and threshold-column must be set together"}
+	}
+	if q.FastInterval < 0 || q.SlowInterval < 0 {
+		return &ValidationError{Query: q.Name, Field: "fast-interval", Reason: "fast-interval and slow-interval must not be negative"}
+	}
+	if q.ProcessTimeout < 0 {
+		return &ValidationError{Query: q.Name, Field: "process-timeout", Reason: "process-timeout must not be negative"}
+	}
+	if q.StaleAfter < 0 {
+		return &ValidationError{Query: q.Name, Field: "stale-after", Reason: "stale-after must not be negative"}
+	}
+	if q.CircuitFailures < 0 {
+		return &ValidationError{Query: q.Name, Field: "circuit-breaker-failures", Reason: "circuit-breaker-failures must not be negative"}
+	}
+	if q.CircuitCooldown < 0 {
+		return &ValidationError{Query: q.Name, Field: "circuit-breaker-cooldown", Reason: "circuit-breaker-cooldown must not be negative"}
+	}
+	if q.Round != nil && *q.Round < 0 {
+		return &ValidationError{Query: q.Name, Field: "round", Reason: "round must not be negative"}
+	}
+	if q.MaxSeries < 0 {
+		return &ValidationError{Query: q.Name, Field: "max-series", Reason: "max-series must not be negative"}
+	}
+	switch q.Isolation {
+	case "", IsolationReadUncommitted, IsolationReadCommitted, IsolationRepeatableRead, IsolationSnapshot, IsolationSerializable:
+	default:
+		return &ValidationError{Query: q.Name, Field: "isolation", Reason: fmt.Sprintf("Unsupported isolation [%s]", q.Isolation)}
+	}
+	switch q.TimestampFormat {
+	case "", TimestampFormatRFC3339, TimestampFormatUnix:
+	default:
+		return &ValidationError{Query: q.Name, Field: "timestamp-format", Reason: fmt.Sprintf("Unsupported timestamp-format [%s]", q.TimestampFormat)}
+	}
+	if !validUnitParse(q.UnitParse) {
+		return &ValidationError{Query: q.Name, Field: "unit-parse", Reason: fmt.Sprintf("Unsupported unit-parse [%s]", q.UnitParse)}
+	}
+	switch q.DecimalSep {
+	case "", DecimalSeparatorDot, DecimalSeparatorComma:
+	default:
+		return &ValidationError{Query: q.Name, Field: "decimal-separator", Reason: fmt.Sprintf("Unsupported decimal-separator [%s]", q.DecimalSep)}
+	}
+	switch q.BackoffReset {
+	case "", BackoffResetFull, BackoffResetSoft:
+	default:
+		return &ValidationError{Query: q.Name, Field: "backoff-reset", Reason: fmt.Sprintf("Unsupported backoff-reset [%s]", q.BackoffReset)}
+	}
+	for col, t := range q.LabelTransforms {
+		if t == nil {
+			return &ValidationError{Query: q.Name, Field: "label-transforms", Reason: fmt.Sprintf("Transform is empty for column [%s]", col)}
+		}
+		switch t.Case {
+		case "", CaseLower, CaseUpper, CasePreserve:
+		default:
+			return &ValidationError{Query: q.Name, Field: "label-transforms", Reason: fmt.Sprintf("Unsupported case [%s] for column [%s]", t.Case, col)}
+		}
+		if t.Regex != "" && t.re == nil {
+			return &ValidationError{Query: q.Name, Field: "label-transforms", Reason: fmt.Sprintf("Regex is not compiled for column [%s]", col)}
+		}
+	}
+	if q.Filter != "" && q.filter == nil {
+		return &ValidationError{Query: q.Name, Field: "filter", Reason: "Filter is not compiled"}
+	}
+	if q.Expression != "" {
+		if q.DataField != "" || q.ValueColumn != nil || len(q.SubMetrics) > 0 {
+			return &ValidationError{Query: q.Name, Field: "expression", Reason: "expression is not compatible with data-field, value-column-index or sub-metrics"}
+		}
+		if q.expr == nil {
+			return &ValidationError{Query: q.Name, Field: "expression", Reason: "Expression is not compiled"}
+		}
+	}
+	for suffix, sm := range q.SubMetrics {
+		if sm.Column == "" && sm.Expression == "" {
+			return &ValidationError{Query: q.Name, Field: "sub-metrics", Reason: fmt.Sprintf("Column is not defined for sub-metric [%s]", suffix)}
+		}
+		if sm.Column != "" && sm.Expression != "" {
+			return &ValidationError{Query: q.Name, Field: "sub-metrics", Reason: fmt.Sprintf("Column and expression are exclusive for sub-metric [%s]", suffix)}
+		}
+		if sm.Expression != "" && sm.expr == nil {
+			return &ValidationError{Query: q.Name, Field: "sub-metrics", Reason: fmt.Sprintf("Expression is not compiled for sub-metric [%s]", suffix)}
+		}
+		if !validUnitParse(sm.UnitParse) {
+			return &ValidationError{Query: q.Name, Field: "sub-metrics", Reason: fmt.Sprintf("Unsupported unit-parse [%s] for sub-metric [%s]", sm.UnitParse, suffix)}
+		}
+		if sm.Round != nil && *sm.Round < 0 {
+			return &ValidationError{Query: q.Name, Field: "sub-metrics", Reason: fmt.Sprintf("round must not be negative for sub-metric [%s]", suffix)}
+		}
+		// A column is either the value of a sub-metric or a facet, never both.
+		if col := strings.ToLower(sm.Column); col != "" {
+			if _, ok := q.LabelTransforms[col]; ok {
+				return &ValidationError{Query: q.Name, Field: "sub-metrics", Reason: fmt.Sprintf("Column [%s] of sub-metric [%s] has label-transforms as a facet", col, suffix)}
+			}
+			for label := range q.Labels {
+				if strings.ToLower(label) == col {
+					return &ValidationError{Query: q.Name, Field: "sub-metrics", Reason: fmt.Sprintf("Column [%s] of sub-metric [%s] is also a label", col, suffix)}
+				}
+			}
+			if col == q.TimestampField {
+				return &ValidationError{Query: q.Name, Field: "sub-metrics", Reason: fmt.Sprintf("Column [%s] of sub-metric [%s] is the timestamp-field", col, suffix)}
+			}
+			if col == strings.ToLower(q.SubMetricsLabel) {
+				return &ValidationError{Query: q.Name, Field: "sub-metrics", Reason: fmt.Sprintf("Column [%s] of sub-metric [%s] is the sub-metrics-as-label", col, suffix)}
+			}
+		}
 	}
 
 	return nil
@@ -138,11 +866,50 @@ func loadConfig(file string) (*Config, error) {
 	if err := validateConfig(&c); err != nil {
 		return nil, err
 	}
+	for name, ds := range c.DataSources {
+		if err := resolveSecretFiles(name, &ds); err != nil {
+			return nil, err
+		}
+		if ds.DSN != "" {
+			if ds.Properties == nil {
+				ds.Properties = make(map[string]interface{}, 1)
+			}
+			ds.Properties["dsn"] = ds.DSN
+		}
+		c.DataSources[name] = ds
+	}
 
 	return &c, err
 }
 
 func loadQueryConfig(queriesFile string, config *Config) (QueryList, error) {
+	if queriesFile == "-" {
+		log.Print("Load queries from stdin")
+		// Includes are relative to the working directory.
+		return decodeQueriesWithIncludes(stdin, config, func(path string) (QueryList, error) {
+			return loadQueryFile(path, config, nil)
+		})
+	}
+	return loadQueryFile(queriesFile, config, nil)
+}
+
+// stdin is read by loadQueryConfig for the queries file "-".
+var stdin io.Reader = os.Stdin
+
+// loadQueryFile loads a queries file and the files it includes, relative to
+// its directory. The stack holds the files being loaded to detect cycles.
+func loadQueryFile(queriesFile string, config *Config, stack []string) (QueryList, error) {
+	abs, err := filepath.Abs(queriesFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening queries file: %s", err)
+	}
+	for _, f := range stack {
+		if f == abs {
+			return nil, fmt.Errorf("Include cycle: %s", strings.Join(append(stack, abs), " -> "))
+		}
+	}
+	stack = append(stack, abs)
+
 	log.Printf("Load queries from file [%s]", queriesFile)
 	// Read queries for request body.
 	file, err := os.Open(queriesFile)
@@ -151,56 +918,511 @@ func loadQueryConfig(queriesFile string, config *Config) (QueryList, error) {
 	}
 
 	defer file.Close()
-	return decodeQueries(file, config)
+	queries, err := decodeQueriesWithIncludes(file, config, func(path string) (QueryList, error) {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(queriesFile), path)
+		}
+		return loadQueryFile(path, config, stack)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Included queries keep the file they were loaded from.
+	for _, q := range queries {
+		if q.sourceFile == "" {
+			q.sourceFile = queriesFile
+		}
+	}
+	return queries, nil
 }
 
+// queryEntry is an item of a queries file, either queries by name or an
+// include directive listing other queries files.
+type queryEntry struct {
+	Queries map[string]*Query
+	Include []string
+}
+
+func (e *queryEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var keys map[string]interface{}
+	if err := unmarshal(&keys); err == nil && len(keys) == 1 {
+		if _, ok := keys["include"]; ok {
+			var include struct {
+				Include []string `yaml:"include"`
+			}
+			if err := unmarshal(&include); err != nil {
+				return err
+			}
+			e.Include = include.Include
+			return nil
+		}
+	}
+
+	return unmarshal(&e.Queries)
+}
+
+// includeFunc loads the queries of an included file.
+type includeFunc func(path string) (QueryList, error)
+
 func decodeQueries(r io.Reader, config *Config) (QueryList, error) {
+	return decodeQueriesWithIncludes(r, config, nil)
+}
+
+// decodeQueriesWithIncludes decodes queries, loading included files in
+// place. Includes are an error without an include function.
+func decodeQueriesWithIncludes(r io.Reader, config *Config, include includeFunc) (QueryList, error) {
 	if config == nil {
 		return nil, errors.New("Bug! Config must not be nil")
 	}
 
 	queries := make(QueryList, 0)
-	parsedQueries := make([]map[string]*Query, 0)
+	parsedQueries := make([]queryEntry, 0)
 
 	b, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
 
+	// Expand environment variables.
+	b = []byte(expandQueryEnv(string(b)))
+
 	if err = yaml.Unmarshal(b, &parsedQueries); err != nil {
 		return nil, err
 	}
 
-	for _, data := range parsedQueries {
-		for k, q := range data {
-			q.Name = k
-			if q.DataSourceRef == "" {
-				q.DataSourceRef = config.Defaults.DataSourceRef
+	for _, entry := range parsedQueries {
+		if entry.Include != nil {
+			if include == nil {
+				return nil, errors.New("Include is only supported in queries files given by -queries")
 			}
-			if q.Driver == "" {
-				if q.DataSourceRef != "" && len(config.DataSources) > 0 {
-					var ds = config.DataSources[q.DataSourceRef]
-					q.Driver = ds.Driver
-					q.Connection = ds.Properties
+			for _, path := range entry.Include {
+				q, err := include(path)
+				if err != nil {
+					return nil, err
 				}
+				queries = append(queries, q...)
 			}
-			if q.Interval == 0 {
-				q.Interval = config.Defaults.QueryInterval
+			continue
+		}
+
+		for k, parsed := range entry.Queries {
+			parsed.Name = k
+			expanded, err := expandDataSources(parsed)
+			if err != nil {
+				return nil, err
 			}
-			if q.Timeout == 0 {
-				q.Timeout = config.Defaults.QueryTimeout
+
+			for _, q := range expanded {
+				if q.DataSourceRef == "" {
+					q.DataSourceRef = config.Defaults.DataSourceRef
+				}
+				// A query may take the connection from its data source while
+				// keeping its own driver and vice versa. Connection properties
+				// of the query are merged over those of the data source.
+				var ds DataSource
+				driver, connection := q.Driver, q.Connection
+				if q.DataSourceRef != "" {
+					var ok bool
+					if ds, ok = config.DataSources[q.DataSourceRef]; !ok {
+						return nil, &ValidationError{Query: q.Name, Field: "data-source", Reason: fmt.Sprintf("Unknown data source [%s]", q.DataSourceRef)}
+					}
+					if q.Driver == "" {
+						q.Driver = ds.Driver
+					}
+					q.Connection = mergeProperties(ds.Properties, q.Connection)
+					q.acceptHeaders = ds.AcceptHeaders
+				}
+				// Fallbacks are resolved the same way as the primary data source.
+				q.fallbacks = nil
+				for _, ref := range q.FallbackRefs {
+					ds, ok := config.DataSources[ref]
+					if !ok {
+						return nil, &ValidationError{Query: q.Name, Field: "data-source", Reason: fmt.Sprintf("Unknown fallback data source [%s]", ref)}
+					}
+					if driver != "" {
+						ds.Driver = driver
+					}
+					ds.Properties = mergeProperties(ds.Properties, connection)
+					q.fallbacks = append(q.fallbacks, ds)
+				}
+				if q.Interval == 0 {
+					q.Interval = ds.QueryInterval
+				}
+				if q.Interval == 0 {
+					q.Interval = config.Defaults.QueryInterval
+				}
+				if q.Timeout == 0 {
+					q.Timeout = ds.QueryTimeout
+				}
+				if q.Timeout == 0 {
+					q.Timeout = config.Defaults.QueryTimeout
+				}
+				if q.Namespace == "" {
+					q.Namespace = config.Defaults.Namespace
+				}
+				if q.Subsystem == "" {
+					q.Subsystem = config.Defaults.Subsystem
+				}
+				if q.ValueOnError == "" && config.Defaults.QueryValueOnError != "" {
+					q.ValueOnError = config.Defaults.QueryValueOnError
+				}
+				if len(config.Defaults.DefaultParams) > 0 {
+					params := make(map[string]interface{}, len(config.Defaults.DefaultParams)+len(q.Params))
+					for k, v := range config.Defaults.DefaultParams {
+						params[k] = v
+					}
+					// Query level params take precedence over the defaults.
+					for k, v := range q.Params {
+						params[k] = v
+					}
+					q.Params = params
+				}
+				if err := applyParamsAsLabels(q); err != nil {
+					return nil, err
+				}
+				q.DataField = strings.ToLower(q.DataField)
+				q.TimestampField = strings.ToLower(q.TimestampField)
+				if err := compileLabelTransforms(q); err != nil {
+					return nil, err
+				}
+				if err := compileFilter(q); err != nil {
+					return nil, err
+				}
+				if err := compileExpressions(q); err != nil {
+					return nil, err
+				}
+				if err := validateQuery(q, config.Strict); err != nil {
+					return nil, err
+				}
+				// Without the prefix the query name is the metric name.
+				if config.NoDefaultPrefix && q.Namespace == "" && q.Subsystem == "" && !metricNamePattern.MatchString(q.Name) {
+					return nil, &ValidationError{Query: q.Name, Field: "name", Reason: fmt.Sprintf("Invalid metric name [%s] with -no-default-prefix", q.Name)}
+				}
+
+				queries = append(queries, q)
 			}
-			if q.ValueOnError == "" && config.Defaults.QueryValueOnError != "" {
-				q.ValueOnError = config.Defaults.QueryValueOnError
+		}
+
+	}
+
+	return queries, nil
+}
+
+// mergeProperties deep merges the override properties over the base
+// properties without modifying either. Keys of override win on conflict.
+func mergeProperties(base, override map[string]interface{}) map[string]interface{} {
+	if len(base) == 0 && len(override) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]interface{}, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		if b, ok := toStringMap(merged[k]); ok {
+			if o, ok := toStringMap(v); ok {
+				merged[k] = mergeProperties(b, o)
+				continue
 			}
-			q.DataField = strings.ToLower(q.DataField)
-			if err := validateQuery(q); err != nil {
-				return nil, err
+		}
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// toStringMap converts nested YAML maps, which are decoded with interface
+// keys, to string keyed maps.
+func toStringMap(v interface{}) (map[string]interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return t, true
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprintf("%v", k)] = v
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+// sensitiveKeys are substrings of property names whose values are redacted
+// when exposing the configuration.
+var sensitiveKeys = []string{"password", "passwd", "secret", "token", "credential", "dsn"}
+
+const redacted = "<redacted>"
+
+// redactProperties returns a copy of the properties with the values of
+// sensitive keys replaced, descending into nested maps.
+func redactProperties(props map[string]interface{}) map[string]interface{} {
+	return redactPropertiesWith(props, nil)
+}
+
+// redactPropertiesWith is redactProperties which also redacts the given
+// secret keys.
+func redactPropertiesWith(props map[string]interface{}, secrets map[string]bool) map[string]interface{} {
+	if props == nil {
+		return nil
+	}
+
+	r := make(map[string]interface{}, len(props))
+	for k, v := range props {
+		if isSensitiveKey(k) || secrets[k] {
+			r[k] = redacted
+		} else if m, ok := toStringMap(v); ok {
+			r[k] = redactProperties(m)
+		} else {
+			r[k] = v
+		}
+	}
+	return r
+}
+
+func isSensitiveKey(k string) bool {
+	k = strings.ToLower(k)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactedConfig returns a copy of the config and queries safe for display.
+func redactedConfig(c *Config, queries QueryList) (*Config, QueryList) {
+	rc := *c
+	rc.Defaults.DefaultParams = redactProperties(c.Defaults.DefaultParams)
+	if u, err := url.Parse(c.ProxyURL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			rc.ProxyURL = strings.Replace(c.ProxyURL, u.User.String()+"@", u.User.Username()+":"+redacted+"@", 1)
+		}
+	}
+	if c.DataSources != nil {
+		rc.DataSources = make(map[string]DataSource, len(c.DataSources))
+		for name, ds := range c.DataSources {
+			ds.Properties = redactPropertiesWith(ds.Properties, ds.secrets)
+			if ds.DSN != "" {
+				ds.DSN = redacted
+			}
+			rc.DataSources[name] = ds
+		}
+	}
+
+	rq := make(QueryList, 0, len(queries))
+	for _, q := range queries {
+		rcq := *q
+		rcq.Connection = redactPropertiesWith(q.Connection, c.DataSources[q.DataSourceRef].secrets)
+		rcq.Params = redactProperties(q.Params)
+		rq = append(rq, &rcq)
+	}
+
+	return &rc, rq
+}
+
+// configHash returns the hex encoded SHA256 of the configuration and
+// queries, to tell whether instances loaded the same configuration. The
+// queries are hashed by name since the order of queries defined in the same
+// list item varies between loads.
+func configHash(c *Config, queries QueryList) (string, error) {
+	sorted := append(QueryList(nil), queries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.DataSourceRef != b.DataSourceRef {
+			return a.DataSourceRef < b.DataSourceRef
+		}
+		return a.sourceFile < b.sourceFile
+	})
+
+	b, err := yaml.Marshal(struct {
+		Config  *Config   `yaml:"config"`
+		Queries QueryList `yaml:"queries"`
+	}{c, sorted})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// compileLabelTransforms compiles the regexes of a query's label transforms
+// and lowercases the column names to match facet names.
+func compileLabelTransforms(q *Query) error {
+	if len(q.LabelTransforms) == 0 {
+		return nil
+	}
+
+	transforms := make(map[string]*LabelTransform, len(q.LabelTransforms))
+	for col, t := range q.LabelTransforms {
+		if t != nil && t.Regex != "" && t.re == nil {
+			re, err := regexp.Compile(t.Regex)
+			if err != nil {
+				return &ValidationError{Query: q.Name, Field: "label-transforms", Reason: fmt.Sprintf("Invalid regex for column [%s]: %s", col, err)}
 			}
+			t.re = re
+		}
+		transforms[strings.ToLower(col)] = t
+	}
+	q.LabelTransforms = transforms
+
+	return nil
+}
+
+// compileExpressions compiles the value expressions of a query and its
+// sub-metrics.
+func compileExpressions(q *Query) error {
+	if q.Expression != "" {
+		e, err := compileExpr(q.Expression)
+		if err != nil {
+			return &ValidationError{Query: q.Name, Field: "expression", Reason: err.Error()}
+		}
+		q.expr = e
+	}
+	for suffix, sm := range q.SubMetrics {
+		if sm.Expression == "" {
+			continue
+		}
+		e, err := compileExpr(sm.Expression)
+		if err != nil {
+			return &ValidationError{Query: q.Name, Field: "sub-metrics", Reason: fmt.Sprintf("%s for sub-metric [%s]", err, suffix)}
+		}
+		sm.expr = e
+		q.SubMetrics[suffix] = sm
+	}
+
+	return nil
+}
+
+var filterPattern = regexp.MustCompile(`^\s*([^\s=!<>]+)\s*(==|!=|>=|<=|=|>|<)\s*(.*?)\s*$`)
+
+// applyParamsAsLabels adds the params listed in params-as-labels to the
+// labels of a query, keeping both in sync.
+func applyParamsAsLabels(q *Query) error {
+	if len(q.ParamsAsLabels) == 0 {
+		return nil
+	}
+
+	labels := make(map[string]string, len(q.Labels)+len(q.ParamsAsLabels))
+	for k, v := range q.Labels {
+		labels[k] = v
+	}
+	for _, p := range q.ParamsAsLabels {
+		v, ok := q.Params[p]
+		if !ok {
+			return &ValidationError{Query: q.Name, Field: "params-as-labels", Reason: fmt.Sprintf("Unknown param [%s]", p)}
+		}
+		if _, ok := labels[p]; ok {
+			return &ValidationError{Query: q.Name, Field: "params-as-labels", Reason: fmt.Sprintf("Param [%s] is already a label", p)}
+		}
+		labels[p] = fmt.Sprintf("%v", v)
+	}
+	q.Labels = labels
+	return nil
+}
+
+// compileFilter parses the filter of a query, which has the form
+// "column op value". Quoted values are compared as strings.
+func compileFilter(q *Query) error {
+	if q.Filter == "" {
+		return nil
+	}
 
-			queries = append(queries, q)
+	m := filterPattern.FindStringSubmatch(q.Filter)
+	if m == nil || m[3] == "" {
+		return &ValidationError{Query: q.Name, Field: "filter", Reason: fmt.Sprintf("Invalid filter [%s], expected column op value", q.Filter)}
+	}
+
+	f := &rowFilter{column: strings.ToLower(m[1]), op: m[2], value: m[3]}
+	if f.op == "==" {
+		f.op = "="
+	}
+	if n := len(f.value); n >= 2 && (f.value[0] == '\'' || f.value[0] == '"') && f.value[n-1] == f.value[0] {
+		f.value = f.value[1 : n-1]
+		f.quoted = true
+	}
+	if f.quoted && f.op != "=" && f.op != "!=" {
+		return &ValidationError{Query: q.Name, Field: "filter", Reason: fmt.Sprintf("Only = and != compare strings in filter [%s]", q.Filter)}
+	}
+	q.filter = f
+
+	return nil
+}
+
+var queryEnvPattern = regexp.MustCompile(`\$\$?(\{[A-Za-z_][A-Za-z0-9_]*\}|[A-Za-z_][A-Za-z0-9_]*)`)
+
+// expandQueryEnv expands $VAR and ${VAR} in query files. In contrast to
+// config files, references to unset variables are left as is so SQL such as
+// positional $1 parameters keeps working. $$VAR and $${VAR} are always a
+// literal $VAR and ${VAR}, any other $$ such as PostgreSQL dollar quoting is
+// kept.
+func expandQueryEnv(s string) string {
+	return queryEnvPattern.ReplaceAllStringFunc(s, func(m string) string {
+		ref := m[1:]
+		if strings.HasPrefix(ref, "$") {
+			return ref
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(ref, "{"), "}")
+		if v, ok := os.LookupEnv(name); ok {
+			return v
 		}
+		return m
+	})
+}
 
+// expandDataSources fans out a query referencing a list of data sources into
+// one query per data source, each labeled with the name of its data source.
+func expandDataSources(q *Query) ([]*Query, error) {
+	if len(q.DataSourceRefs) == 0 {
+		return []*Query{q}, nil
+	}
+	if q.DataSourceRef != "" {
+		return nil, &ValidationError{Query: q.Name, Field: "data-sources", Reason: "data-source and data-sources are mutually exclusive"}
+	}
+
+	expanded := make([]*Query, 0, len(q.DataSourceRefs))
+	for _, ref := range q.DataSourceRefs {
+		c := *q
+		c.DataSourceRef = ref
+		c.DataSourceRefs = nil
+		c.Labels = map[string]string{DataSourceLabel: ref}
+		for k, v := range q.Labels {
+			c.Labels[k] = v
+		}
+		expanded = append(expanded, &c)
+	}
+
+	return expanded, nil
+}
+
+// loadQueriesInDirs loads the queries of several directories, in order. A
+// directory listed more than once is loaded only once. A query name may only
+// be used in one file, its metrics would collide otherwise.
+func loadQueriesInDirs(paths []string, config *Config, allowFileErrors bool) (QueryList, error) {
+	queries := make(QueryList, 0)
+	seen := make(map[string]bool, len(paths))
+	files := make(map[string]string)
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		q, err := loadQueriesInDir(path, config, allowFileErrors)
+		if err != nil {
+			return nil, err
+		}
+		for _, query := range q {
+			if fn, ok := files[query.Name]; ok && fn != query.sourceFile {
+				return nil, &ValidationError{Query: query.Name, Field: "name", Reason: fmt.Sprintf("Query defined in both %s and %s", fn, query.sourceFile)}
+			}
+			files[query.Name] = query.sourceFile
+		}
+		queries = append(queries, q...)
 	}
 
 	return queries, nil
@@ -209,33 +1431,77 @@ func decodeQueries(r io.Reader, config *Config) (QueryList, error) {
 func loadQueriesInDir(path string, config *Config, allowFileErrors bool) (QueryList, error) {
 	log.Printf("Load queries from directory [%s]", path)
 	queries := make(QueryList, 0)
-	files, err := ioutil.ReadDir(path)
+	files, err := queryFiles(path, config.Recursive, config.QueryGlob)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, f := range files {
-		fn := f.Name()
-		if strings.HasSuffix(fn, ".yml") {
-			fn := fmt.Sprintf("%s/%s", strings.TrimRight(path, "/"), fn)
-			log.Println("Loading", fn)
-			file, err := os.Open(fn)
-			if err != nil {
-				return nil, err
-			}
+	for _, fn := range files {
+		log.Println("Loading", fn)
+		file, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
 
-			q, err := decodeQueries(file, config)
-			file.Close()
+		q, err := decodeQueries(file, config)
+		file.Close()
 
-			if err == nil {
-				queries = append(queries, q...)
-			} else if allowFileErrors {
-				log.Printf("Ignoring error loading %s. err=%v", fn, err)
-			} else {
-				return nil, err
+		if err == nil {
+			for _, query := range q {
+				query.sourceFile = fn
 			}
+			queries = append(queries, q...)
+		} else if allowFileErrors {
+			log.Printf("Ignoring error loading %s. err=%v", fn, err)
+		} else {
+			return nil, err
 		}
 	}
 
 	return queries, nil
 }
+
+// queryFiles lists the files of a directory whose name matches the glob,
+// by default the .yml files. When recursive, files at any depth are listed
+// and the default also matches .yaml files.
+func queryFiles(path string, recursive bool, glob string) ([]string, error) {
+	if glob == "" {
+		glob = DefaultQueryGlob
+	}
+
+	var files []string
+	if !recursive {
+		infos, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range infos {
+			ok, err := filepath.Match(glob, f.Name())
+			if err != nil {
+				return nil, fmt.Errorf("Invalid query glob [%s]: %s", glob, err)
+			}
+			if ok {
+				files = append(files, fmt.Sprintf("%s/%s", strings.TrimRight(path, "/"), f.Name()))
+			}
+		}
+		return files, nil
+	}
+
+	err := filepath.Walk(path, func(fn string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return nil
+		}
+		ok, err := filepath.Match(glob, f.Name())
+		if err != nil {
+			return fmt.Errorf("Invalid query glob [%s]: %s", glob, err)
+		}
+		if ok || glob == DefaultQueryGlob && strings.HasSuffix(fn, ".yaml") {
+			files = append(files, fn)
+		}
+		return nil
+	})
+	return files, err
+}
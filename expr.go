@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// exprNode is a node of an arithmetic expression over the columns of a row.
+// Leaves are numbers or columns, other nodes apply op to left and right.
+type exprNode struct {
+	op          byte
+	num         float64
+	column      string
+	left, right *exprNode
+}
+
+// compileExpr parses an expression of numbers, column names, parentheses and
+// the operators + - * /, e.g. "success_count / total_count".
+func compileExpr(s string) (*exprNode, error) {
+	p := &exprParser{s: s}
+	n, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.s) {
+		return nil, fmt.Errorf("Unexpected [%s] in expression [%s]", p.s[p.pos:], s)
+	}
+	return n, nil
+}
+
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	if p.skipSpace(); p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) parseSum() (*exprNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseProduct() (*exprNode, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseFactor() (*exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		n, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("Missing ) in expression [%s]", p.s)
+		}
+		p.pos++
+		return n, nil
+	case c == '-':
+		p.pos++
+		n, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{op: '-', left: &exprNode{}, right: n}, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.s) && (p.s[p.pos] >= '0' && p.s[p.pos] <= '9' || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number in expression [%s]: %s", p.s, err)
+		}
+		return &exprNode{num: f}, nil
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		start := p.pos
+		for p.pos < len(p.s) && isExprIdent(p.s[p.pos]) {
+			p.pos++
+		}
+		return &exprNode{column: strings.ToLower(p.s[start:p.pos])}, nil
+	case c == 0:
+		return nil, fmt.Errorf("Unexpected end of expression [%s]", p.s)
+	}
+	return nil, fmt.Errorf("Unexpected [%c] in expression [%s]", c, p.s)
+}
+
+func isExprIdent(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// columns reports the columns the expression refers to.
+func (n *exprNode) columns(cols map[string]bool) {
+	if n == nil {
+		return
+	}
+	if n.column != "" {
+		cols[n.column] = true
+	}
+	n.left.columns(cols)
+	n.right.columns(cols)
+}
+
+// eval evaluates the expression with the values of a row.
+func (n *exprNode) eval(row record, decimalSep string) (float64, error) {
+	if n.op == 0 {
+		if n.column == "" {
+			return n.num, nil
+		}
+		for k, v := range row {
+			if strings.ToLower(k) == n.column {
+				return parseValue(v, "", decimalSep)
+			}
+		}
+		return 0, fmt.Errorf("Expression column [%s] not found in result set", n.column)
+	}
+
+	l, err := n.left.eval(row, decimalSep)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.right.eval(row, decimalSep)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	}
+	if r == 0 {
+		return 0, errors.New("Division by zero in expression")
+	}
+	return l / r, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Readiness tracks which queries have not completed their first successful
+// fetch yet. It reports ready once all queries did or the deadline passed.
+type Readiness struct {
+	mu      sync.Mutex
+	pending map[queryID]string // Names of the queries by ID
+	fetched map[queryID]bool
+	ready   bool
+	done    chan struct{}
+	closed  bool
+}
+
+// NewReadiness creates a readiness gate waiting for all queries.
+func NewReadiness(queries QueryList) *Readiness {
+	r := &Readiness{
+		fetched: make(map[queryID]bool),
+		done:    make(chan struct{}),
+	}
+	r.Reload(queries)
+
+	return r
+}
+
+// Reload waits for the given queries instead, e.g. those of a reloaded
+// configuration. Queries already fetched are not waited for again.
+func (r *Readiness) Reload(queries QueryList) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending = make(map[queryID]string, len(queries))
+	for _, q := range queries {
+		if id := idOf(q); !r.fetched[id] {
+			r.pending[id] = q.Name
+		}
+	}
+	r.closeIfDone()
+}
+
+// Fetched marks the first successful fetch of a query.
+func (r *Readiness) Fetched(q *Query) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := idOf(q)
+	if _, ok := r.pending[id]; !ok {
+		return
+	}
+	delete(r.pending, id)
+	r.fetched[id] = true
+	r.closeIfDone()
+}
+
+// closeIfDone must be called with the lock held. Once closed, queries added
+// by a reload keep the gate incomplete but don't reopen it.
+func (r *Readiness) closeIfDone() {
+	if len(r.pending) == 0 && !r.closed {
+		close(r.done)
+		r.closed = true
+	}
+}
+
+// Wait blocks until all queries have been fetched or the timeout passed,
+// after which the gate reports ready regardless. Queries that never
+// succeeded are logged.
+func (r *Readiness) Wait(timeout time.Duration) {
+	select {
+	case <-r.done:
+		log.Print("All queries have been fetched, ready")
+	case <-time.After(timeout):
+		r.mu.Lock()
+		for _, name := range r.pending {
+			log.Printf("Query [%s] was not fetched successfully within %s", name, timeout)
+		}
+		r.mu.Unlock()
+		log.Print("Reporting ready anyway")
+	}
+
+	r.mu.Lock()
+	r.ready = true
+	r.mu.Unlock()
+}
+
+// Complete reports whether all queries have been fetched, regardless of
+// any timeout.
+func (r *Readiness) Complete() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.pending) == 0
+}
+
+// Ready reports whether the gate is open.
+func (r *Readiness) Ready() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.ready
+}
+
+// healthHandler reports the service as healthy. When a readiness gate is
+// given, it reports unavailable until the gate opens.
+func healthHandler(r *Readiness) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r != nil && !r.Ready() {
+			http.Error(w, "waiting for first fetch", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// warmupHandler reports unavailable until all warmup queries have been
+// fetched, and serves h afterwards.
+func warmupHandler(warmup *Readiness, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !warmup.Complete() {
+			http.Error(w, "waiting for warmup queries", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -1,37 +1,96 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 	"golang.org/x/net/context"
 	"gopkg.in/tylerb/graceful.v1"
+	"gopkg.in/yaml.v2"
 )
 
+// buildVersion is set at build time, see the Makefile.
+var buildVersion = "dev"
+
 func main() {
-	log.Println("prometheus-sql starting up...")
+	log.Printf("prometheus-sql %s starting up...", buildVersion)
 	var (
 		host                         string
 		port                         int
+		socket                       string
+		metricsPath                  string
 		service                      string
 		queriesFile                  string
 		queryDir                     string
 		confFile                     string
 		tolerateInvalidQueryDirFiles bool
+		strict                       bool
+		maxResponseBytes             int64
+		recursive                    bool
+		queryGlob                    string
+		labelSourceFile              bool
+		noDefaultPrefix              bool
+		noInitialTick                bool
+		oneshot                      bool
+		maxRuntime                   time.Duration
+		maxQueries                   int
+		labelCase                    string
+		fetchDurationHistogram       bool
+		checkAgent                   bool
+		exposeConfig                 bool
+		shutdownTimeout              time.Duration
+		checkAgentTimeout            time.Duration
+		waitForFirstFetch            bool
+		firstFetchTimeout            time.Duration
+		textfileDir                  string
 	)
 
 	flag.StringVar(&host, "host", DefaultHost, "Host of the service.")
 	flag.IntVar(&port, "port", DefaultPort, "Port of the service.")
+	flag.StringVar(&socket, "socket", DefaultSocket, "Path of a Unix socket to serve on instead of host:port.")
+	flag.StringVar(&metricsPath, "metrics-path", DefaultMetricsPath, "Path under which to expose metrics.")
 	flag.StringVar(&service, "service", DefaultService, "Query of SQL agent service.")
-	flag.StringVar(&queriesFile, "queries", DefaultQueriesFile, "Path to file containing queries.")
-	flag.StringVar(&queryDir, "queryDir", DefaultQueriesDir, "Path to directory containing queries.")
+	flag.StringVar(&queriesFile, "queries", DefaultQueriesFile, "Path to file containing queries, - to read them from stdin.")
+	flag.StringVar(&queryDir, "queryDir", DefaultQueriesDir, "Path to directory containing queries, or a comma-separated list of directories.")
+	flag.BoolVar(&recursive, "recursive", DefaultRecursive, "Load query files in subdirectories of queryDir, as .yml or .yaml.")
+	flag.StringVar(&queryGlob, "queryGlob", DefaultQueryGlob, "Pattern of the file names loaded from queryDir.")
+	flag.BoolVar(&labelSourceFile, "label-source-file", DefaultLabelSourceFile, "Label query metrics with the file the query was loaded from.")
+	flag.BoolVar(&noDefaultPrefix, "no-default-prefix", DefaultNoDefaultPrefix, "Name query metrics by the query alone, without the query_result_ prefix.")
 	flag.StringVar(&confFile, "config", DefaultConfFile, "Configuration file to define common data sources etc.")
-	flag.BoolVar(&tolerateInvalidQueryDirFiles, "lax", DefaultTolerateInvalidQueryDirFiles, "Tolerate invalid files in queryDir")
+	flag.BoolVar(&tolerateInvalidQueryDirFiles, "lax", DefaultTolerateInvalidQueryDirFiles, "Tolerate invalid files in queryDir and queries that fail to start")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", DefaultShutdownTimeout, "Time to wait for requests and then for workers to finish on shutdown.")
+	flag.BoolVar(&exposeConfig, "expose-config", DefaultExposeConfig, "Expose the effective configuration at /config.")
+	flag.BoolVar(&checkAgent, "check-agent", DefaultCheckAgent, "Check that the SQL agent service responds before starting.")
+	flag.DurationVar(&checkAgentTimeout, "check-agent-timeout", DefaultCheckAgentTimeout, "Time to wait for the SQL agent service to respond on startup.")
+	flag.Int64Var(&maxResponseBytes, "max-response-bytes", DefaultMaxResponseBytes, "Maximum size of a response from the SQL agent, 0 for no limit.")
+	flag.BoolVar(&noInitialTick, "no-initial-tick", DefaultNoInitialTick, "Wait one interval before the first fetch of each query instead of fetching on startup.")
+	flag.BoolVar(&oneshot, "oneshot", DefaultOneshot, "Fetch every query once, print the metrics and exit.")
+	flag.DurationVar(&maxRuntime, "max-runtime", DefaultMaxRuntime, "Maximum total runtime with -oneshot, 0 for no limit.")
+	flag.IntVar(&maxQueries, "max-queries", DefaultMaxQueries, "Maximum number of queries to load, 0 for no limit. Exceeding it is an error, or a warning with -lax.")
+	flag.StringVar(&labelCase, "label-case", DefaultLabelCase, "Case of facet label names and values: lower, upper or preserve.")
+	flag.BoolVar(&fetchDurationHistogram, "fetch-duration-histogram", DefaultFetchDurationHistogram, "Expose the fetch duration of queries as a histogram instead of a gauge of the last fetch.")
+	flag.BoolVar(&strict, "strict", DefaultStrict, "Treat configuration warnings as errors.")
+	flag.BoolVar(&waitForFirstFetch, "wait-for-first-fetch", DefaultWaitForFirstFetch, "Report /healthz unavailable until every query was fetched once.")
+	flag.DurationVar(&firstFetchTimeout, "first-fetch-timeout", DefaultFirstFetchTimeout, "Time after which /healthz reports ready even if not every query was fetched.")
+
+	flag.StringVar(&textfileDir, "textfile-dir", DefaultTextfileDir, "Write the metrics to "+TextfileName+" in this directory after each fetch instead of serving them, for the node_exporter textfile collector.")
 
 	flag.Parse()
 
@@ -40,6 +99,18 @@ func main() {
 		log.Fatal("Error: URL to SQL Agent service required.")
 	}
 
+	switch labelCase {
+	case CaseLower, CaseUpper, CasePreserve:
+	default:
+		flag.Usage()
+		log.Fatal("Error: -label-case must be lower, upper or preserve.")
+	}
+
+	if !strings.HasPrefix(metricsPath, "/") {
+		flag.Usage()
+		log.Fatal("Error: -metrics-path must start with a slash.")
+	}
+
 	if queriesFile == DefaultQueriesFile && queryDir != "" {
 		queriesFile = ""
 	}
@@ -48,63 +119,388 @@ func main() {
 		log.Fatal("Error: You can specify either -queries or -queryDir")
 	}
 
-	var (
-		err     error
-		queries QueryList
-		config  *Config
-	)
-	config = newConfig()
-	if confFile != "" {
-		config, err = loadConfig(confFile)
+	// Loads the configuration and queries, both on startup and on reload.
+	load := func() (*Config, QueryList, error) {
+		var (
+			err     error
+			queries QueryList
+			config  *Config
+		)
+		config = newConfig()
+		if confFile != "" {
+			config, err = loadConfig(confFile)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		config.Strict = strict
+		config.MaxResponseBytes = maxResponseBytes
+		config.Recursive = recursive
+		config.QueryGlob = queryGlob
+		config.LabelSourceFile = labelSourceFile
+		config.NoDefaultPrefix = noDefaultPrefix
+		config.NoInitialTick = noInitialTick
+		config.LabelCase = labelCase
+		config.FetchDurationHistogram = fetchDurationHistogram
+
+		if queryDir != "" {
+			queries, err = loadQueriesInDirs(splitList(queryDir), config, tolerateInvalidQueryDirFiles)
+		} else {
+			queries, err = loadQueryConfig(queriesFile, config)
+		}
 		if err != nil {
-			log.Fatal(err)
+			return nil, nil, err
 		}
-	}
 
-	if queryDir != "" {
-		queries, err = loadQueriesInDir(queryDir, config, tolerateInvalidQueryDirFiles)
-	} else {
-		queries, err = loadQueryConfig(queriesFile, config)
+		if len(queries) == 0 {
+			return nil, nil, errors.New("No queries loaded!")
+		}
+		if err := checkMaxQueries(queries, maxQueries, tolerateInvalidQueryDirFiles); err != nil {
+			return nil, nil, err
+		}
+
+		return config, queries, nil
 	}
+
+	config, queries, err := load()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if len(queries) == 0 {
-		log.Fatal("No queries loaded!")
+	if checkAgent {
+		if err := probeAgent(service, checkAgentTimeout, config); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	// Wait group of queries.
-	wg := new(sync.WaitGroup)
-	wg.Add(len(queries))
+	if oneshot {
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if maxRuntime > 0 {
+			ctx, cancel = context.WithTimeout(ctx, maxRuntime)
+		}
+		err := runOnce(ctx, service, config, queries, os.Stdout)
+		cancel()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	// Shared context. Close the cxt.Done channel to stop the workers.
 	ctx, cancel := context.WithCancel(context.Background())
 
-	var w *Worker
+	var readiness *Readiness
+	if waitForFirstFetch {
+		readiness = NewReadiness(queries)
+	}
+
+	// Scrapes are unavailable until the warmup queries have been fetched.
+	var warmupQueries QueryList
+	for _, q := range queries {
+		if q.Warmup {
+			warmupQueries = append(warmupQueries, q)
+		}
+	}
+	warmup := NewReadiness(warmupQueries)
+
+	// Under -lax a query whose worker can not be created is skipped.
+	pool := NewPool(ctx, service, tolerateInvalidQueryDirFiles)
+	pool.Readiness = readiness
+	pool.Warmup = warmup
+	var textfile *TextfileWriter
+	if textfileDir != "" {
+		textfile = NewTextfileWriter(textfileDir)
+		pool.OnFetch = textfile.Notify
+		go textfile.Run(ctx)
+	}
+	if err := pool.Start(config, queries); err != nil {
+		log.Fatal(err)
+	}
+
+	if readiness != nil {
+		go readiness.Wait(firstFetchTimeout)
+	}
+
+	// Reload the configuration and queries on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := pool.Reload(load); err != nil {
+				log.Printf("Error reloading configuration, keeping previous one. err=%v", err)
+			}
+		}
+	}()
+
+	if textfile != nil {
+		log.Printf("* Writing metrics to %s...", filepath.Join(textfileDir, TextfileName))
+
+		// Handles OS kill and interrupt.
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		stopWorkers(cancel, pool, shutdownTimeout)
+		return
+	}
 
 	mux := http.NewServeMux()
 
-	for _, q := range queries {
-		// Create a new worker and start it in its own goroutine.
-		// type key string
-		// const wgKey key = "wg"
-		w = NewWorker(context.WithValue(ctx, "wg", wg), q)
-		go w.Start(service)
+	// Register the handlers. Scrapes of the metrics endpoint itself are
+	// counted, like by promhttp.Handler.
+	mux.Handle(metricsPath, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, warmupHandler(warmup,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{}))))
+	mux.Handle("/healthz", healthHandler(readiness))
+	if exposeConfig {
+		mux.Handle("/config", configHandler(pool.Current))
 	}
+	if metricsPath != "/" {
+		mux.Handle("/", landingPage(metricsPath))
+	}
+
+	if socket != "" {
+		log.Printf("* Listening on unix socket %s...", socket)
 
-	// Register the handler.
-	mux.Handle("/metrics", promhttp.Handler())
+		// Handles OS kill and interrupt.
+		srv := &graceful.Server{Timeout: shutdownTimeout, Server: &http.Server{Handler: mux}}
+		if err := serveUnix(socket, srv); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		addr, err := listenAddr(host, port)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("* Listening on %s...", addr)
 
-	addr := fmt.Sprintf("%s:%d", host, port)
-	log.Printf("* Listening on %s...", addr)
+		// Handles OS kill and interrupt.
+		graceful.Run(addr, shutdownTimeout, mux)
+	}
 
-	// Handles OS kill and interrupt.
-	graceful.Run(addr, 5*time.Second, mux)
+	stopWorkers(cancel, pool, shutdownTimeout)
+}
 
+// stopWorkers cancels the workers of the pool and waits up to the timeout
+// for them to finish.
+func stopWorkers(cancel context.CancelFunc, pool *Pool, timeout time.Duration) {
 	log.Print("Canceling workers")
 	cancel()
 	log.Print("Waiting for workers to finish")
+
+	finished := make(chan struct{})
+	go func() {
+		pool.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		log.Println("All workers have finished, exiting!")
+	case <-time.After(timeout):
+		log.Printf("Workers did not finish within %s, exiting!", timeout)
+	}
+}
+
+// runOnce fetches every query once, concurrently, and writes the resulting
+// metrics in the text format. An error is returned if any query failed,
+// e.g. because the context expired.
+func runOnce(ctx context.Context, service string, config *Config, queries QueryList, out io.Writer) error {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+
+	for _, q := range queries {
+		w, err := NewWorker(ctx, q, config)
+		if err != nil {
+			return err
+		}
+		defer w.unregisterMetrics()
+
+		wg.Add(1)
+		go func(w *Worker) {
+			defer wg.Done()
+			if _, err := w.Fetch(service); err != nil {
+				w.log.Printf("Error fetching records: %s", err)
+				mu.Lock()
+				failed = append(failed, w.query.Name)
+				mu.Unlock()
+			}
+		}(w)
+	}
 	wg.Wait()
-	log.Println("All workers have finished, exiting!")
+
+	if err := writeMetrics(out); err != nil {
+		return err
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Error: %d of %d queries failed: %s", len(failed), len(queries), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// writeMetrics writes the registered metrics in the text format.
+func writeMetrics(out io.Writer) error {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("Error gathering metrics: %s", err)
+	}
+	enc := expfmt.NewEncoder(out, expfmt.FmtText)
+	for _, mf := range mfs {
+		// Only the query results are of interest, not the process itself.
+		if strings.HasPrefix(mf.GetName(), "go_") || strings.HasPrefix(mf.GetName(), "process_") {
+			continue
+		}
+		if err := enc.Encode(mf); err != nil {
+			return fmt.Errorf("Error writing metrics: %s", err)
+		}
+	}
+	return nil
+}
+
+const landingPageTemplate = `<html>
+<head><title>Prometheus SQL</title></head>
+<body>
+<h1>Prometheus SQL</h1>
+<p><a href="%s">Metrics</a></p>
+</body>
+</html>
+`
+
+// landingPage returns a handler for the root path linking to the metrics.
+func landingPage(metricsPath string) http.Handler {
+	page := fmt.Sprintf(landingPageTemplate, html.EscapeString(metricsPath))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		w.Write([]byte(page))
+	})
+}
+
+// configHandler serves the effective configuration and queries as YAML with
+// secrets redacted.
+func configHandler(current func() (*Config, QueryList)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc, rq := redactedConfig(current())
+		b, err := yaml.Marshal(struct {
+			Config  *Config   `yaml:"config"`
+			Queries QueryList `yaml:"queries"`
+		}{rc, rq})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "text/yaml; charset=utf-8")
+		w.Write(b)
+	})
+}
+
+// probeAgent checks that the SQL agent service responds to a request within
+// the timeout, with the protocol and proxy the workers use. Any HTTP response
+// counts as the agent being available.
+func probeAgent(url string, timeout time.Duration, config *Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	client, err := newAgentClient(config, 0)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("Error creating agent probe: %s", err)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("Error: agent probe timed out after %s", timeout)
+		}
+		return fmt.Errorf("Error: agent probe failed: %s", err)
+	}
+	resp.Body.Close()
+
+	log.Printf("SQL agent at %s responded with %s", url, resp.Status)
+	return nil
+}
+
+// checkMaxQueries guards against loading a runaway number of queries, each
+// of which would start a worker. With lax the limit is only logged.
+func checkMaxQueries(queries QueryList, max int, lax bool) error {
+	if max <= 0 || len(queries) <= max {
+		return nil
+	}
+	if lax {
+		log.Printf("Warning: loaded %d queries, more than -max-queries %d", len(queries), max)
+		return nil
+	}
+
+	return fmt.Errorf("Loaded %d queries, more than -max-queries %d", len(queries), max)
+}
+
+// splitList splits a comma-separated flag value, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// listenAddr joins host and port into an address suitable for listening on.
+// IPv6 literals are accepted with or without surrounding brackets.
+func listenAddr(host string, port int) (string, error) {
+	if port < 0 || port > 65535 {
+		return "", fmt.Errorf("Invalid port [%d]", port)
+	}
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("Invalid IPv6 host [%s]", host)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// serveUnix serves the handler on a Unix domain socket with graceful shutdown
+// enabled. A stale socket file left behind by a previous run is replaced and
+// the socket file is removed once the server stops.
+func serveUnix(path string, srv *graceful.Server) error {
+	l, err := listenUnix(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	return srv.Serve(l)
+}
+
+// listenUnix listens on a Unix domain socket, replacing a stale socket file.
+// Any other file at the path is kept and reported as an error.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("Error: %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("Error removing stale socket file: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Error checking socket file: %s", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Error listening on socket: %s", err)
+	}
+	return l, nil
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"gopkg.in/tylerb/graceful.v1"
+)
+
+func Test_listenAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		port    int
+		want    string
+		wantErr bool
+	}{
+		{name: "all-interfaces", host: "", port: 8080, want: ":8080"},
+		{name: "ipv4", host: "127.0.0.1", port: 8080, want: "127.0.0.1:8080"},
+		{name: "hostname", host: "localhost", port: 9090, want: "localhost:9090"},
+		{name: "ipv6", host: "::1", port: 8080, want: "[::1]:8080"},
+		{name: "ipv6-brackets", host: "[::1]", port: 8080, want: "[::1]:8080"},
+		{name: "ipv6-invalid", host: "::zz", port: 8080, wantErr: true},
+		{name: "port-out-of-range", host: "localhost", port: 70000, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := listenAddr(tt.host, tt.port)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("listenAddr() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("listenAddr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_probeAgent(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer ok.Close()
+
+	if err := probeAgent(ok.URL, time.Second, newConfig()); err != nil {
+		t.Errorf("probeAgent() error = %v", err)
+	}
+
+	release := make(chan struct{})
+	hang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hang.Close()
+	defer close(release)
+
+	err := probeAgent(hang.URL, 50*time.Millisecond, newConfig())
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("probeAgent() error = %v, want timeout", err)
+	}
+
+	// The probe goes through the proxy-url like the workers.
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	c := newConfig()
+	c.ProxyURL = proxy.URL
+	if err := probeAgent("http://agent.invalid/", time.Second, c); err != nil {
+		t.Errorf("probeAgent() through proxy error = %v", err)
+	}
+	if proxied != "http://agent.invalid/" {
+		t.Errorf("proxy got %q, want the agent URL", proxied)
+	}
+}
+
+func Test_warmupHandler(t *testing.T) {
+	warm, cold := &Query{Name: "warm", Warmup: true}, &Query{Name: "cold"}
+	warmup := NewReadiness(QueryList{warm})
+	h := warmupHandler(warmup, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	}))
+
+	scrape := func() int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Code
+	}
+
+	if code := scrape(); code != http.StatusServiceUnavailable {
+		t.Errorf("before warmup status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	warmup.Fetched(cold)
+	if code := scrape(); code != http.StatusServiceUnavailable {
+		t.Errorf("after other query status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	warmup.Fetched(warm)
+	if code := scrape(); code != http.StatusOK {
+		t.Errorf("after warmup status = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func Test_healthHandler(t *testing.T) {
+	check := func(h http.Handler) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		return rec.Code
+	}
+
+	if code := check(healthHandler(nil)); code != http.StatusOK {
+		t.Errorf("without a gate status = %d, want %d", code, http.StatusOK)
+	}
+
+	a, b := &Query{Name: "a"}, &Query{Name: "b"}
+	readiness := NewReadiness(QueryList{a, b})
+	h := healthHandler(readiness)
+	waited := make(chan struct{})
+	go func() {
+		readiness.Wait(time.Minute)
+		close(waited)
+	}()
+
+	if code := check(h); code != http.StatusServiceUnavailable {
+		t.Errorf("before first fetch status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	readiness.Fetched(a)
+	if code := check(h); code != http.StatusServiceUnavailable {
+		t.Errorf("after one query status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	readiness.Fetched(b)
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("gate did not open after every query was fetched")
+	}
+	if code := check(h); code != http.StatusOK {
+		t.Errorf("after first fetch status = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func Test_readinessTimeout(t *testing.T) {
+	readiness := NewReadiness(QueryList{{Name: "never"}})
+	readiness.Wait(10 * time.Millisecond)
+
+	if !readiness.Ready() {
+		t.Error("gate not ready after the first-fetch-timeout")
+	}
+	if readiness.Complete() {
+		t.Error("gate complete although the query was never fetched")
+	}
+	rec := httptest.NewRecorder()
+	healthHandler(readiness).ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("after timeout status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func Test_splitList(t *testing.T) {
+	got := splitList(" a, b,,c ,")
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("splitList() = %v, want %v", got, want)
+	}
+}
+
+func Test_checkMaxQueries(t *testing.T) {
+	queries := QueryList{{Name: "a"}, {Name: "b"}}
+	if err := checkMaxQueries(queries, 0, false); err != nil {
+		t.Errorf("no limit: %v", err)
+	}
+	if err := checkMaxQueries(queries, 2, false); err != nil {
+		t.Errorf("at limit: %v", err)
+	}
+	if err := checkMaxQueries(queries, 1, false); err == nil {
+		t.Error("expected an error over the limit")
+	}
+	if err := checkMaxQueries(queries, 1, true); err != nil {
+		t.Errorf("lax: %v", err)
+	}
+}
+
+func Test_runOnce(t *testing.T) {
+	agent := newMockAgent(t, "test-resources/agent/fixtures.json")
+	defer agent.Close()
+
+	queries, err := loadQueryConfig("test-resources/agent/queries.yml", newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runOnce(context.Background(), agent.URL, newConfig(), queries, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"query_result_sales_total 42", `query_result_sales_by_country{country="usa"} 5`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output misses %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "go_goroutines") {
+		t.Errorf("output contains process metrics:\n%s", out.String())
+	}
+
+	// A failing query is retried until the deadline and reported.
+	failing := QueryList{{Name: "unknown", SQL: "select missing", Interval: time.Minute, Timeout: time.Minute}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := runOnce(ctx, agent.URL, newConfig(), failing, ioutil.Discard); err == nil {
+		t.Error("runOnce() returned no error for a failing query")
+	}
+}
+
+func Test_textfileWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "textfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "query_result_textfile_test", Help: "Test"})
+	g.Set(7)
+	prometheus.MustRegister(g)
+	defer prometheus.Unregister(g)
+
+	w := NewTextfileWriter(dir)
+	if err := w.Write(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, TextfileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "query_result_textfile_test 7") {
+		t.Errorf("textfile misses the metric:\n%s", b)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("files = %d, want only %s", len(files), TextfileName)
+	}
+
+	// Notifications never block, even without a running writer.
+	w.Notify()
+	w.Notify()
+}
+
+func Test_serveUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "prometheus-sql.sock")
+
+	// A regular file at the path is kept.
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &graceful.Server{Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}}
+	if err := serveUnix(path, srv); err == nil {
+		t.Fatal("expected an error for a regular file")
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "data" {
+		t.Errorf("regular file was replaced, now %q", b)
+	}
+	os.Remove(path)
+
+	// A stale socket is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- serveUnix(path, srv) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	var resp *http.Response
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if resp, err = client.Get("http://unix/"); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "ok" {
+		t.Errorf("response = %q, want ok", b)
+	}
+
+	// The socket file is removed once the server stops.
+	srv.Stop(time.Second)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serveUnix() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file was not removed, err=%v", err)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// LoadFunc loads the configuration and queries, e.g. from files.
+type LoadFunc func() (*Config, QueryList, error)
+
+// Pool runs a worker per query and replaces all workers on reload.
+type Pool struct {
+	ctx     context.Context
+	service string
+	lax     bool
+
+	// OnFetch, if set, is called by the workers after each fetch.
+	OnFetch func()
+	// Readiness and Warmup, if set, are told about the first successful
+	// fetch of all queries and of the warmup queries, respectively. They are
+	// reloaded with the queries of each reload.
+	Readiness *Readiness
+	Warmup    *Readiness
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	wg      *sync.WaitGroup
+	config  *Config
+	queries QueryList
+	workers []*Worker
+
+	reloads    *prometheus.CounterVec
+	restarts   prometheus.Counter
+	lastReload time.Time
+	info       *prometheus.GaugeVec
+	hash       *prometheus.GaugeVec
+	metrics    []prometheus.Collector // All of the above, for unregistering
+}
+
+// NewPool creates a pool of workers querying the service. Workers are
+// stopped when the context is done.
+func NewPool(ctx context.Context, service string, lax bool) *Pool {
+	p := &Pool{
+		ctx:     ctx,
+		service: service,
+		lax:     lax,
+		wg:      new(sync.WaitGroup),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prometheus_sql_reloads_total",
+			Help: "Number of configuration reloads by result.",
+		}, []string{"result"}),
+		restarts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_sql_worker_restarts_total",
+			Help: "Number of workers stopped and replaced by a reload.",
+		}),
+		lastReload: time.Now(),
+		info: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "query_result_info",
+			Help: "Configured queries, always 1.",
+		}, []string{"query", "driver", "data_source", "interval"}),
+		hash: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "prometheus_sql_config_hash_info",
+			Help: "SHA256 of the loaded configuration and queries, always 1.",
+		}, []string{"hash"}),
+	}
+
+	p.reloads.WithLabelValues("success")
+	p.reloads.WithLabelValues("failure")
+	p.metrics = []prometheus.Collector{
+		p.reloads,
+		p.restarts,
+		p.info,
+		p.hash,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "prometheus_sql_last_reload_timestamp_seconds",
+			Help: "Time of the last successful configuration load as a Unix timestamp.",
+		}, func() float64 {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return float64(p.lastReload.UnixNano()) / 1e9
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "prometheus_sql_seconds_since_last_reload",
+			Help: "Seconds since the last successful configuration load.",
+		}, func() float64 {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return time.Since(p.lastReload).Seconds()
+		}),
+	}
+	for _, c := range p.metrics {
+		prometheus.MustRegister(c)
+	}
+
+	return p
+}
+
+// unregisterMetrics unregisters the metrics of the pool, not of its workers.
+func (p *Pool) unregisterMetrics() {
+	for _, c := range p.metrics {
+		prometheus.Unregister(c)
+	}
+}
+
+// queryID identifies a query across reloads. Queries expanded from a list of
+// data sources share their name.
+type queryID struct {
+	name, dataSource string
+}
+
+func idOf(q *Query) queryID {
+	return queryID{q.Name, q.DataSourceRef}
+}
+
+// Start creates and starts a worker per query. Under lax a query whose
+// worker can not be created is skipped.
+func (p *Pool) Start(config *Config, queries QueryList) error {
+	workers, cancel, err := p.newWorkers(config, queries)
+	if err != nil {
+		return err
+	}
+	p.start(config, queries, workers, cancel)
+
+	return nil
+}
+
+// newWorkers creates a worker per query without starting them. The workers
+// are stopped by canceling the returned function.
+func (p *Pool) newWorkers(config *Config, queries QueryList) ([]*Worker, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(p.ctx)
+
+	workers := make([]*Worker, 0, len(queries))
+	for _, q := range queries {
+		w, err := NewWorker(ctx, q, config)
+		if err != nil {
+			if !p.lax {
+				cancel()
+				return nil, nil, err
+			}
+			log.Printf("Ignoring query [%s]. err=%v", q.Name, err)
+			continue
+		}
+		w.onFetch = p.OnFetch
+		workers = append(workers, w)
+	}
+
+	if len(workers) == 0 {
+		cancel()
+		return nil, nil, errors.New("No queries loaded!")
+	}
+
+	return workers, cancel, nil
+}
+
+// start starts the created workers, which report their first successful
+// fetch to the readiness gates. The gates stop waiting for skipped queries.
+func (p *Pool) start(config *Config, queries QueryList, workers []*Worker, cancel context.CancelFunc) {
+	var started, warmup QueryList
+	for _, w := range workers {
+		q := w.query
+		started = append(started, q)
+		if q.Warmup {
+			warmup = append(warmup, q)
+		}
+		w.onFirstFetch = func() {
+			if p.Readiness != nil {
+				p.Readiness.Fetched(q)
+			}
+			if p.Warmup != nil {
+				p.Warmup.Fetched(q)
+			}
+		}
+	}
+	if p.Readiness != nil {
+		p.Readiness.Reload(started)
+	}
+	if p.Warmup != nil {
+		p.Warmup.Reload(warmup)
+	}
+
+	wg := new(sync.WaitGroup)
+	p.mu.Lock()
+	p.cancel = cancel
+	p.wg = wg
+	p.config = config
+	p.queries = queries
+	p.workers = workers
+	p.mu.Unlock()
+
+	p.setInfo(queries)
+	p.setHash(config, queries)
+
+	// Start each worker in its own goroutine.
+	wg.Add(len(workers))
+	for _, w := range workers {
+		go w.Start(p.service, wg)
+	}
+}
+
+// setInfo replaces the info series with one per configured query.
+func (p *Pool) setInfo(queries QueryList) {
+	p.info.Reset()
+	for _, q := range queries {
+		p.info.WithLabelValues(q.Name, q.Driver, q.DataSourceRef, q.Interval.String()).Set(1)
+	}
+}
+
+// setHash replaces the hash series with the hash of the configuration and
+// queries.
+func (p *Pool) setHash(config *Config, queries QueryList) {
+	hash, err := configHash(config, queries)
+	if err != nil {
+		log.Printf("Error hashing configuration. err=%v", err)
+		return
+	}
+	log.Printf("Configuration hash is %s", hash)
+	p.hash.Reset()
+	p.hash.WithLabelValues(hash).Set(1)
+}
+
+// Stop stops the running workers and waits for them to finish.
+func (p *Pool) Stop() {
+	p.mu.Lock()
+	cancel, wg := p.cancel, p.wg
+	p.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	wg.Wait()
+}
+
+// Wait waits for the running workers to finish.
+func (p *Pool) Wait() {
+	p.mu.Lock()
+	wg := p.wg
+	p.mu.Unlock()
+
+	wg.Wait()
+}
+
+// Current returns the configuration and queries of the running workers.
+func (p *Pool) Current() (*Config, QueryList) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.config, p.queries
+}
+
+// Reload loads the configuration and replaces the running workers. If the
+// configuration can not be loaded or its workers can not be created the
+// running workers are kept.
+func (p *Pool) Reload(load LoadFunc) error {
+	log.Print("Reloading configuration")
+
+	config, queries, err := load()
+	if err != nil {
+		p.reloads.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	// Create the new workers before stopping the running ones, so a failure
+	// doesn't leave a gap in the metrics.
+	workers, cancel, err := p.newWorkers(config, queries)
+	if err != nil {
+		p.reloads.WithLabelValues("failure").Inc()
+		log.Printf("Error starting reloaded queries, keeping previous ones. err=%v", err)
+		return err
+	}
+
+	p.mu.Lock()
+	stopped := p.workers
+	p.mu.Unlock()
+	p.Stop()
+
+	// The min-fetch-gap of a query also applies to its replacement.
+	lastFetch := make(map[queryID]time.Time, len(stopped))
+	for _, w := range stopped {
+		lastFetch[idOf(w.query)] = w.lastFetch
+	}
+	restarted := 0
+	for _, w := range workers {
+		if t, ok := lastFetch[idOf(w.query)]; ok {
+			w.lastFetch = t
+			restarted++
+		}
+	}
+
+	p.start(config, queries, workers, cancel)
+	// Every worker of a query kept by the reload is replaced, even for an
+	// unchanged query. Removed queries are not restarted.
+	p.restarts.Add(float64(restarted))
+
+	p.mu.Lock()
+	p.lastReload = time.Now()
+	p.mu.Unlock()
+	p.reloads.WithLabelValues("success").Inc()
+	log.Printf("Reloaded %d queries", len(queries))
+
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
+)
+
+// loadAgentQueries loads the queries of the agent fixtures.
+func loadAgentQueries() (*Config, QueryList, error) {
+	queries, err := loadQueryConfig("test-resources/agent/queries.yml", newConfig())
+	return newConfig(), queries, err
+}
+
+// startTestPool starts a pool of the loaded queries. Stop the pool and
+// unregister its metrics when done.
+func startTestPool(t *testing.T, p *Pool, load LoadFunc) {
+	config, queries, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(config, queries); err != nil {
+		p.unregisterMetrics()
+		t.Fatal(err)
+	}
+}
+
+func (p *Pool) running() []*Worker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.workers
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	metric := &dto.Metric{}
+	c.Write(metric)
+	return metric.GetCounter().GetValue()
+}
+
+func TestPoolReload(t *testing.T) {
+	agent := newMockAgent(t, "test-resources/agent/fixtures.json")
+	defer agent.Close()
+
+	load := LoadFunc(loadAgentQueries)
+	p := NewPool(context.Background(), agent.URL, false)
+	startTestPool(t, p, load)
+	defer p.unregisterMetrics()
+	defer p.Stop()
+
+	counts := func(step string, success, failure, restarts float64) {
+		if v := counterValue(p.reloads.WithLabelValues("success")); v != success {
+			t.Errorf("%s: successful reloads = %v, want %v", step, v, success)
+		}
+		if v := counterValue(p.reloads.WithLabelValues("failure")); v != failure {
+			t.Errorf("%s: failed reloads = %v, want %v", step, v, failure)
+		}
+		if v := counterValue(p.restarts); v != restarts {
+			t.Errorf("%s: worker restarts = %v, want %v", step, v, restarts)
+		}
+	}
+	kept := func(step string, workers []*Worker) {
+		running := p.running()
+		if len(running) != len(workers) {
+			t.Fatalf("%s: %d workers running, want %d", step, len(running), len(workers))
+		}
+		for i, w := range workers {
+			if running[i] != w || w.ctx.Err() != nil {
+				t.Errorf("%s: worker [%s] was replaced", step, w.query.Name)
+			}
+		}
+	}
+
+	// A successful reload replaces every worker.
+	before := p.running()
+	if err := p.Reload(load); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range before {
+		if w.ctx.Err() == nil {
+			t.Errorf("previous worker [%s] is still running", w.query.Name)
+		}
+	}
+	if len(p.running()) != 2 {
+		t.Errorf("%d workers running, want 2", len(p.running()))
+	}
+	counts("success", 1, 0, 2)
+
+	// A configuration which can't be loaded keeps the running workers.
+	running := p.running()
+	err := p.Reload(func() (*Config, QueryList, error) {
+		return nil, nil, errors.New("broken configuration")
+	})
+	if err == nil {
+		t.Error("expected an error for a broken configuration")
+	}
+	kept("failed load", running)
+	counts("failed load", 1, 1, 2)
+
+	// So do workers which can't be created.
+	err = p.Reload(func() (*Config, QueryList, error) {
+		config, queries, err := load()
+		config.PayloadTemplate = "{{"
+		return config, queries, err
+	})
+	if err == nil {
+		t.Error("expected an error for an invalid payload-template")
+	}
+	kept("failed start", running)
+	counts("failed start", 1, 2, 2)
+	if config, _ := p.Current(); config.PayloadTemplate != "" {
+		t.Errorf("current payload-template = %q, want the previous configuration", config.PayloadTemplate)
+	}
+}
+
+func TestPoolReloadGates(t *testing.T) {
+	agent := newMockAgent(t, "test-resources/agent/fixtures.json")
+	defer agent.Close()
+
+	// The agent holds requests until released.
+	var (
+		mu      sync.Mutex
+		release = make(chan struct{})
+	)
+	held := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		c := release
+		mu.Unlock()
+		<-c
+		agent.serve(w, r)
+	}))
+	defer held.Close()
+	releaseAll := func() {
+		mu.Lock()
+		close(release)
+		mu.Unlock()
+	}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+	warmupQueries := func(names ...string) LoadFunc {
+		return func() (*Config, QueryList, error) {
+			config, queries, err := loadAgentQueries()
+			for _, q := range queries {
+				for _, name := range names {
+					q.Warmup = q.Warmup || q.Name == name
+				}
+			}
+			return config, queries, err
+		}
+	}
+
+	// The gate waits for the warmup queries once the pool starts.
+	p := NewPool(context.Background(), held.URL, false)
+	p.Warmup = NewReadiness(nil)
+	startTestPool(t, p, warmupQueries("sales_total"))
+	defer p.unregisterMetrics()
+	defer p.Stop()
+
+	complete := func(step string) {
+		for deadline := time.Now().Add(5 * time.Second); !p.Warmup.Complete(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: warmup did not complete", step)
+			}
+		}
+	}
+
+	// A reload before the first fetch waits for the reloaded queries.
+	if err := p.Reload(warmupQueries("sales_total")); err != nil {
+		t.Fatal(err)
+	}
+	if p.Warmup.Complete() {
+		t.Fatal("warmup complete before the first fetch")
+	}
+	releaseAll()
+	complete("reload before first fetch")
+
+	// A warmup query added by a reload gates the metrics again.
+	mu.Lock()
+	release = make(chan struct{})
+	mu.Unlock()
+	if err := p.Reload(warmupQueries("sales_total", "sales_by_country")); err != nil {
+		t.Fatal(err)
+	}
+	if p.Warmup.Complete() {
+		t.Fatal("warmup complete before the added query was fetched")
+	}
+	releaseAll()
+	complete("added warmup query")
+}
+
+func TestPoolReloadMinFetchGap(t *testing.T) {
+	agent := newMockAgent(t, "test-resources/agent/fixtures.json")
+	defer agent.Close()
+
+	load := func() (*Config, QueryList, error) {
+		config, queries, err := loadAgentQueries()
+		for _, q := range queries {
+			q.MinFetchGap = time.Hour
+		}
+		return config, queries, err
+	}
+
+	fetched := make(chan struct{}, 4)
+	p := NewPool(context.Background(), agent.URL, false)
+	p.OnFetch = func() { fetched <- struct{}{} }
+	wait := func() {
+		for i := 0; i < 2; i++ {
+			select {
+			case <-fetched:
+			case <-time.After(5 * time.Second):
+				t.Fatal("queries were not fetched")
+			}
+		}
+	}
+	startTestPool(t, p, load)
+	defer p.unregisterMetrics()
+	defer p.Stop()
+	wait()
+
+	// The replaced workers skip their first fetch within the gap.
+	if err := p.Reload(load); err != nil {
+		t.Fatal(err)
+	}
+	wait()
+	if n := len(agent.Requests()); n != 2 {
+		t.Errorf("agent got %d requests, want 2 within the min-fetch-gap", n)
+	}
+}
+
+func TestPoolWorkerRestarts(t *testing.T) {
+	agent := newMockAgent(t, "test-resources/agent/fixtures.json")
+	defer agent.Close()
+
+	p := NewPool(context.Background(), agent.URL, false)
+	startTestPool(t, p, loadAgentQueries)
+	defer p.unregisterMetrics()
+	defer p.Stop()
+
+	if v := counterValue(p.restarts); v != 0 {
+		t.Errorf("worker restarts = %v after start, want 0", v)
+	}
+
+	// Only the replaced workers are counted, neither those of removed nor
+	// of added queries.
+	first := func() (*Config, QueryList, error) {
+		config, queries, err := loadAgentQueries()
+		return config, queries[:1], err
+	}
+	steps := []struct {
+		load LoadFunc
+		want float64
+	}{
+		{load: first, want: 1},
+		{load: loadAgentQueries, want: 2},
+		{load: loadAgentQueries, want: 4},
+	}
+	for i, step := range steps {
+		if err := p.Reload(step.load); err != nil {
+			t.Fatal(err)
+		}
+		if v := counterValue(p.restarts); v != step.want {
+			t.Errorf("reload %d: worker restarts = %v, want %v", i+1, v, step.want)
+		}
+	}
+}
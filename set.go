@@ -4,10 +4,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"math"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
 )
 
 type metricStatus int
@@ -15,11 +21,29 @@ type metricStatus int
 const (
 	registered metricStatus = iota
 	unregistered
+	dropped
 )
 
 type QueryResult struct {
 	Query  *Query
 	Result map[string]prometheus.Gauge // Internally we represent each facet with a JSON-encoded string for simplicity
+
+	mu sync.RWMutex // Guards Result
+
+	droppedSeries prometheus.Counter // Counts series dropped due to max-series
+	droppedLogged bool
+
+	seriesCount prometheus.Gauge // Number of registered series
+
+	labelCase string // Case of facet labels, lower by default
+	// updated is the time each metric was last set, with a stale-after.
+	updated map[string]time.Time
+	// labelSourceFile adds the file of the query as the file label.
+	labelSourceFile bool
+	// noDefaultPrefix drops the query_result_ prefix of metric names.
+	noDefaultPrefix bool
+
+	log *log.Logger
 }
 
 // NewSetMetrics initializes a new metrics collector.
@@ -27,115 +51,502 @@ func NewQueryResult(q *Query) *QueryResult {
 	r := &QueryResult{
 		Query:  q,
 		Result: make(map[string]prometheus.Gauge),
+		log:    log.New(os.Stderr, fmt.Sprintf("[%s] ", q.Name), log.LstdFlags),
+		seriesCount: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        fmt.Sprintf("query_result_%s_series_count", q.Name),
+			Help:        "Number of series currently registered for an SQL query",
+			ConstLabels: q.Labels,
+		}),
+	}
+
+	if q.MaxSeries > 0 {
+		r.droppedSeries = prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        fmt.Sprintf("query_result_%s_dropped_series_total", q.Name),
+			Help:        "Number of series not created because max-series was reached",
+			ConstLabels: q.Labels,
+		})
 	}
 
 	return r
 }
 
-func (r *QueryResult) registerMetric(facets map[string]interface{}, suffix string) (string, metricStatus) {
+// dropSeries accounts for a series that was not created because the query
+// reached its max-series limit. The counter is registered on first use.
+func (r *QueryResult) dropSeries(key string) {
+	if !r.droppedLogged {
+		r.log.Printf("Reached max-series limit of %d, dropping %s and further new series", r.Query.MaxSeries, key)
+		if err := prometheus.Register(r.droppedSeries); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				r.log.Printf("Error registering dropped series counter: %s", err)
+			}
+		}
+		r.droppedLogged = true
+	}
+	r.droppedSeries.Inc()
+}
+
+// registerMetric must be called with the lock held. The max-series limit
+// applies to the live metrics, those set so far in the current fetch and
+// those kept by the stale-after. Other metrics of the previous fetch are
+// about to be unregistered.
+func (r *QueryResult) registerMetric(set map[string]metricStatus, facets map[string]interface{}, suffix string, sm SubMetric) (string, metricStatus) {
 	labels := prometheus.Labels{}
+	for k, v := range r.Query.Labels {
+		labels[k] = v
+	}
+	for k, v := range sm.Labels {
+		labels[k] = v
+	}
+	if r.labelSourceFile && r.Query.sourceFile != "" {
+		labels[SourceFileLabel] = r.Query.sourceFile
+	}
 	metricName := r.Query.Name
 	if suffix != "" {
 		metricName = fmt.Sprintf("%s_%s", r.Query.Name, suffix)
 	}
 
-	jsonData, _ := json.Marshal(facets)
+	// The key is based on the transformed label values so facets which end
+	// up with identical labels share a single gauge.
+	facetLabels := make(map[string]string, len(facets))
+	for k, v := range facets {
+		value := fmt.Sprintf("%v", v)
+		if t, ok := r.Query.LabelTransforms[strings.ToLower(k)]; ok {
+			value = t.Apply(value, r.labelCase)
+		} else {
+			value = applyCase(value, r.labelCase)
+		}
+		facetLabels[k] = value
+		labels[k] = value
+	}
+
+	jsonData, _ := json.Marshal(facetLabels)
 	resultKey := fmt.Sprintf("%s%s", metricName, string(jsonData))
 
-	for k, v := range facets {
-		labels[k] = strings.ToLower(fmt.Sprintf("%v", v))
+	if r.Query.MaxSeries > 0 {
+		now := time.Now()
+		if !r.isLive(set, resultKey, now) && r.liveSeries(set, now) >= r.Query.MaxSeries {
+			r.dropSeries(resultKey)
+			return resultKey, dropped
+		}
 	}
 
 	if _, ok := r.Result[resultKey]; ok { // A metric with this name is already registered
 		return resultKey, registered
 	}
 
-	fmt.Println("Creating", resultKey)
-	r.Result[resultKey] = prometheus.NewGauge(prometheus.GaugeOpts{
+	help := "Result of an SQL query"
+	if sm.Help != "" {
+		help = sm.Help
+	}
+
+	// Without a namespace or subsystem metrics keep the legacy prefix,
+	// unless it is disabled.
+	opts := prometheus.GaugeOpts{
 		Name:        fmt.Sprintf("query_result_%s", metricName),
-		Help:        "Result of an SQL query",
+		Help:        help,
 		ConstLabels: labels,
-	})
+	}
+	if r.noDefaultPrefix {
+		opts.Name = metricName
+	}
+	if r.Query.Namespace != "" || r.Query.Subsystem != "" {
+		opts.Namespace = r.Query.Namespace
+		opts.Subsystem = r.Query.Subsystem
+		opts.Name = metricName
+	}
+
+	fmt.Println("Creating", resultKey)
+	r.Result[resultKey] = prometheus.NewGauge(opts)
 	return resultKey, unregistered
 }
 
 type record map[string]interface{}
 type records []record
 
-func setValueForResult(r prometheus.Gauge, v interface{}) error {
+// byteUnits maps lowercase size suffixes to their multiplier in bytes.
+var byteUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1e3,
+	"kb":  1e3,
+	"m":   1e6,
+	"mb":  1e6,
+	"g":   1e9,
+	"gb":  1e9,
+	"t":   1e12,
+	"tb":  1e12,
+	"p":   1e15,
+	"pb":  1e15,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+	"pib": 1 << 50,
+}
+
+// parseBytes parses a size such as "512MB" or "1.5 GiB" into bytes.
+func parseBytes(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r == '.' || r == '-' || r == '+')
+	})
+	if i < 0 {
+		i = len(s)
+	}
+
+	f, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, err
+	}
+	m, ok := byteUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("Unknown size unit in [%s]", s)
+	}
+	return f * m, nil
+}
+
+// parseUnit converts a value with a unit into its base unit, bytes or seconds.
+func parseUnit(s string, unit string) (float64, error) {
+	switch unit {
+	case UnitParseBytes:
+		return parseBytes(s)
+	case UnitParseDuration:
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			return 0, err
+		}
+		return d.Seconds(), nil
+	}
+	return 0, fmt.Errorf("Unsupported unit-parse [%s]", unit)
+}
+
+// numberToFloat converts a JSON number. Integers are parsed exactly first,
+// so converting them to a gauge value rounds them at most once.
+func numberToFloat(n json.Number) (float64, error) {
+	if i, err := n.Int64(); err == nil {
+		return float64(i), nil
+	}
+	return n.Float64()
+}
+
+// normalizeDecimal rewrites a number using a decimal comma, e.g. "1.234,56",
+// to the dot-decimal form without grouping understood by ParseFloat.
+func normalizeDecimal(s string, sep string) string {
+	if sep != DecimalSeparatorComma {
+		return s
+	}
+	s = strings.Replace(s, ".", "", -1)
+	s = strings.Replace(s, " ", "", -1)
+	return strings.Replace(s, ",", ".", -1)
+}
+
+// rowFilter selects the rows of a result set whose column compares to a
+// value. Unquoted values are compared numerically when the column value is
+// a number too.
+type rowFilter struct {
+	column string
+	op     string
+	value  string
+	quoted bool
+}
+
+// match reports whether the row passes the filter.
+func (f *rowFilter) match(row record, decimalSep string) (bool, error) {
+	var (
+		v     interface{}
+		found bool
+	)
+	for k, rv := range row {
+		if strings.ToLower(k) == f.column {
+			v, found = rv, true
+		}
+	}
+	if !found {
+		return false, fmt.Errorf("Filter column [%s] not found in result set", f.column)
+	}
+
+	if !f.quoted {
+		want, werr := strconv.ParseFloat(normalizeDecimal(f.value, decimalSep), 64)
+		got, gerr := parseValue(v, "", decimalSep)
+		if werr == nil && gerr == nil {
+			switch f.op {
+			case "=":
+				return got == want, nil
+			case "!=":
+				return got != want, nil
+			case ">":
+				return got > want, nil
+			case ">=":
+				return got >= want, nil
+			case "<":
+				return got < want, nil
+			case "<=":
+				return got <= want, nil
+			}
+		}
+	}
+
+	got := fmt.Sprintf("%v", v)
+	switch f.op {
+	case "=":
+		return got == f.value, nil
+	case "!=":
+		return got != f.value, nil
+	}
+	return false, fmt.Errorf("Filter [%s %s %s] needs a numeric value", f.column, f.op, f.value)
+}
+
+// parseValue converts a value of a result set into a float.
+func parseValue(v interface{}, unit string, decimalSep string) (float64, error) {
 	switch t := v.(type) {
 	case string:
-		f, err := strconv.ParseFloat(t, 64)
-		if err != nil {
-			return err
+		t = normalizeDecimal(t, decimalSep)
+		if unit != "" {
+			if f, err := parseUnit(t, unit); err == nil {
+				return f, nil
+			}
 		}
-		r.Set(f)
+		return strconv.ParseFloat(t, 64)
+	case json.Number:
+		return numberToFloat(t)
 	case int:
-		r.Set(float64(t))
+		return float64(t), nil
 	case float64:
-		r.Set(t)
-	default:
-		return fmt.Errorf("Unhandled type %s", t)
+		return t, nil
+	}
+	return 0, fmt.Errorf("Unhandled type %s", v)
+}
+
+// convertValue parses a value of a sub-metric and applies the scale and
+// offset configured for the query, then rounds it to the decimals of the
+// sub-metric or else the query.
+func convertValue(v interface{}, sm SubMetric, q *Query) (float64, error) {
+	f, err := parseValue(v, sm.UnitParse, q.DecimalSep)
+	if err != nil {
+		return 0, err
+	}
+
+	// An explicit scale of 0 is applied, only an unset scale is 1.
+	scale := 1.0
+	if q.Scale != nil {
+		scale = *q.Scale
+	}
+	f = f*scale + q.Offset
+
+	round := sm.Round
+	if round == nil {
+		round = q.Round
+	}
+	if round != nil {
+		f = roundTo(f, *round)
+	}
+	return f, nil
+}
+
+// roundTo rounds to the given number of decimals, halves away from zero.
+func roundTo(f float64, decimals int) float64 {
+	p := math.Pow10(decimals)
+	if f < 0 {
+		return -math.Floor(-f*p+0.5) / p
 	}
-	return nil
+	return math.Floor(f*p+0.5) / p
 }
 
 func (r *QueryResult) SetMetrics(recs records) (map[string]metricStatus, error) {
+	return r.SetMetricsWithColumns(context.Background(), recs, nil)
+}
+
+// SetMetricsWithColumns is SetMetrics for records whose column order is
+// known, which is needed to take the value by value-column-index. Setting
+// the metrics is aborted once the context is done.
+func (r *QueryResult) SetMetricsWithColumns(ctx context.Context, recs records, order []string) (_ map[string]metricStatus, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Query.InfoMetric {
+		return r.setInfoMetrics(recs)
+	}
+
 	// Queries that return only one record should only have one column
 	if len(recs) > 1 && len(recs[0]) == 1 {
 		return nil, errors.New("There is more than one row in the query result - with a single column")
 	}
 
-	if r.Query.DataField != "" && len(r.Query.SubMetrics) > 0 {
-		return nil, errors.New("sub-metrics are not compatible with data-field")
-	}
-
-	submetrics := map[string]string{}
+	submetrics := map[string]SubMetric{}
 
 	if len(r.Query.SubMetrics) > 0 {
 		submetrics = r.Query.SubMetrics
+	} else if len(r.Query.ValueColumns) > 0 {
+		for _, c := range r.Query.ValueColumns {
+			c = strings.ToLower(c)
+			submetrics[c] = SubMetric{Column: c, UnitParse: r.Query.UnitParse}
+		}
 	} else {
-		submetrics = map[string]string{"": r.Query.DataField}
+		datafield := r.Query.DataField
+		for c, role := range r.Query.Columns {
+			if role == ColumnValue {
+				datafield = strings.ToLower(c)
+			}
+		}
+		if r.Query.ValueColumn != nil && order != nil {
+			i := *r.Query.ValueColumn
+			if i >= len(order) {
+				return nil, fmt.Errorf("Value column index %d out of range for %d columns", i, len(order))
+			}
+			datafield = strings.ToLower(order[i])
+		}
+		submetrics = map[string]SubMetric{"": {Column: datafield, UnitParse: r.Query.UnitParse, expr: r.Query.expr}}
+	}
+
+	// Columns of value expressions are neither facets nor gauge data.
+	exprColumns := make(map[string]bool)
+	for _, sm := range submetrics {
+		sm.expr.columns(exprColumns)
+	}
+
+	// With an explicit column mapping, unmapped columns are ignored.
+	var mappedColumns map[string]bool
+	if len(r.Query.Columns) > 0 {
+		mappedColumns = make(map[string]bool, len(r.Query.Columns))
+		for c := range r.Query.Columns {
+			mappedColumns[strings.ToLower(c)] = true
+		}
 	}
 
 	facetsWithResult := make(map[string]metricStatus, 0)
-	for _, row := range recs {
-		for suffix, datafield := range submetrics {
-			facet := make(map[string]interface{})
+	defer func() {
+		if err != nil {
+			r.forgetUnregistered(facetsWithResult)
+		}
+	}()
+	for i, row := range recs {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("Aborted setting metrics after %d of %d rows: %s", i, len(recs), err)
+		}
+		if ok, err := r.filterRow(row); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+
+		// The timestamp column is neither a facet nor gauge data.
+		columns := len(row)
+		var (
+			tsVal   interface{}
+			tsFound bool
+		)
+		if r.Query.TimestampField != "" {
+			for k, v := range row {
+				if strings.ToLower(k) == r.Query.TimestampField {
+					tsVal = v
+					tsFound = true
+					columns--
+				}
+			}
+			if !tsFound {
+				return nil, errors.New("Timestamp field not found in result set")
+			}
+		}
+
+		var facet map[string]interface{}
+		for suffix, sm := range submetrics {
+			datafield := sm.Column
+			facet = make(map[string]interface{})
 			var (
+				dataKey   string
 				dataVal   interface{}
 				dataFound bool
 			)
 			for k, v := range row {
-				if len(row) > 1 && strings.ToLower(k) != datafield { // facet field, add to facets
-					submetric := false
+				if tsFound && strings.ToLower(k) == r.Query.TimestampField {
+					continue
+				}
+				if mappedColumns != nil && !mappedColumns[strings.ToLower(k)] {
+					continue
+				}
+				if sm.expr != nil || columns > 1 && strings.ToLower(k) != datafield { // facet field, add to facets
+					submetric := exprColumns[strings.ToLower(k)]
 					for _, n := range submetrics {
-						if strings.ToLower(k) == n {
+						if strings.ToLower(k) == n.Column {
 							submetric = true
 						}
 					}
 					// it is a facet field and not a submetric field
 					if !submetric {
-						facet[strings.ToLower(fmt.Sprintf("%v", k))] = v
+						facet[applyCase(fmt.Sprintf("%v", k), r.labelCase)] = v
 					}
 				} else { // this is the actual gauge data
 					if dataFound {
 						return nil, errors.New("Data field not specified for multi-column query")
 					}
+					dataKey = k
 					dataVal = v
 					dataFound = true
 				}
 			}
 
+			if sm.expr != nil {
+				f, err := sm.expr.eval(row, r.Query.DecimalSep)
+				if err != nil {
+					// Only this row misses the value, e.g. on a zero divisor.
+					r.log.Printf("Skipping row %d: %s", i, err)
+					continue
+				}
+				dataVal, dataFound = f, true
+			}
+
 			if !dataFound {
 				return nil, errors.New("Data field not found in result set")
 			}
 
-			key, status := r.registerMetric(facet, suffix)
-			err := setValueForResult(r.Result[key], dataVal)
+			// With value-as-label the value is a label of a constant gauge,
+			// e.g. for a status that can't be parsed.
+			var (
+				f   float64
+				err error
+			)
+			if r.Query.ValueAsLabel {
+				facet[applyCase(dataKey, r.labelCase)] = dataVal
+				f = 1
+			} else if f, err = convertValue(dataVal, sm, r.Query); err != nil {
+				return nil, err
+			}
+			// Without a result the metric of a skipped facet is unregistered.
+			if r.Query.SkipZero && f == 0 {
+				continue
+			}
+
+			// With sub-metrics-as-label sub-metrics share the query's metric,
+			// the suffix becomes the value of the label.
+			name, labels := suffix, facet
+			if r.Query.SubMetricsLabel != "" && suffix != "" {
+				labels = make(map[string]interface{}, len(facet)+1)
+				for k, v := range facet {
+					labels[k] = v
+				}
+				labels[r.Query.SubMetricsLabel] = suffix
+				name = ""
+			}
+			key, status := r.registerMetric(facetsWithResult, labels, name, sm)
+			if status == dropped {
+				continue
+			}
+			r.Result[key].Set(f)
+			facetsWithResult[key] = status
+		}
+
+		if tsFound {
+			ts, err := parseTimestamp(tsVal, r.Query.TimestampFormat)
 			if err != nil {
 				return nil, err
 			}
+			key, status := r.registerMetric(facetsWithResult, facet, "data_age_seconds", SubMetric{
+				Help: "Age of the data returned by an SQL query",
+			})
+			if status == dropped {
+				continue
+			}
+			r.Result[key].Set(time.Since(ts).Seconds())
 			facetsWithResult[key] = status
 		}
 	}
@@ -143,20 +554,215 @@ func (r *QueryResult) SetMetrics(recs records) (map[string]metricStatus, error)
 	return facetsWithResult, nil
 }
 
-func (r *QueryResult) RegisterMetrics(facetsWithResult map[string]metricStatus) {
-	for key, m := range r.Result {
-		status, ok := facetsWithResult[key]
-		if !ok {
-			fmt.Println("Unregistering metric", key)
-			prometheus.Unregister(m)
+// forgetUnregistered removes the metrics created while setting a result
+// which failed. They are not registered, and would never be once known.
+func (r *QueryResult) forgetUnregistered(set map[string]metricStatus) {
+	for key, status := range set {
+		if status == unregistered {
 			delete(r.Result, key)
+		}
+	}
+}
+
+// filterRow reports whether a row passes the filter of the query, if any.
+func (r *QueryResult) filterRow(row record) (bool, error) {
+	if r.Query.filter == nil {
+		return true, nil
+	}
+	return r.Query.filter.match(row, r.Query.DecimalSep)
+}
+
+// setInfoMetrics exposes every row as an info metric, all columns become
+// labels and the value is always 1.
+func (r *QueryResult) setInfoMetrics(recs records) (_ map[string]metricStatus, err error) {
+	facetsWithResult := make(map[string]metricStatus, 0)
+	defer func() {
+		if err != nil {
+			r.forgetUnregistered(facetsWithResult)
+		}
+	}()
+	for _, row := range recs {
+		if ok, err := r.filterRow(row); err != nil {
+			return nil, err
+		} else if !ok {
 			continue
 		}
-		if status == unregistered {
-			defer func(key string, m prometheus.Gauge) {
-				fmt.Println("Registering metric", key)
-				prometheus.MustRegister(m)
-			}(key, m)
+
+		facet := make(map[string]interface{}, len(row))
+		for k, v := range row {
+			facet[applyCase(k, r.labelCase)] = v
+		}
+
+		key, status := r.registerMetric(facetsWithResult, facet, "info", SubMetric{
+			Help: "Information returned by an SQL query",
+		})
+		if status == dropped {
+			continue
 		}
+		r.Result[key].Set(1)
+		facetsWithResult[key] = status
+	}
+
+	return facetsWithResult, nil
+}
+
+// parseTimestamp parses a timestamp column value as either an RFC3339 string
+// or a Unix epoch in seconds.
+func parseTimestamp(v interface{}, format string) (time.Time, error) {
+	if format == TimestampFormatUnix {
+		var secs float64
+		switch t := v.(type) {
+		case string:
+			f, err := strconv.ParseFloat(t, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			secs = f
+		case json.Number:
+			f, err := numberToFloat(t)
+			if err != nil {
+				return time.Time{}, err
+			}
+			secs = f
+		case int:
+			secs = float64(t)
+		case float64:
+			secs = t
+		default:
+			return time.Time{}, fmt.Errorf("Unhandled timestamp type %T", t)
+		}
+		sec, frac := math.Modf(secs)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("Unhandled timestamp type %T", v)
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Metrics returns a snapshot of the current gauges by result key.
+func (r *QueryResult) Metrics() map[string]prometheus.Gauge {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m := make(map[string]prometheus.Gauge, len(r.Result))
+	for k, g := range r.Result {
+		m[k] = g
+	}
+	return m
+}
+
+// UnregisterMetrics unregisters and forgets all metrics of the query.
+func (r *QueryResult) UnregisterMetrics() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, m := range r.Result {
+		prometheus.Unregister(m)
+		delete(r.Result, key)
+	}
+	r.updated = nil
+	prometheus.Unregister(r.seriesCount)
+	if r.droppedSeries != nil {
+		prometheus.Unregister(r.droppedSeries)
+		r.droppedLogged = false
+	}
+}
+
+// SweepStale unregisters the metrics not set within the stale-after of the
+// query, e.g. while fetches fail.
+func (r *QueryResult) SweepStale() {
+	if r.Query.StaleAfter == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for key := range r.Result {
+		if !r.isFresh(key, now) {
+			r.unregisterStale(key)
+		}
+	}
+	r.seriesCount.Set(float64(len(r.Result)))
+}
+
+// isLive reports whether a metric was set in the current fetch or is kept
+// by the stale-after.
+func (r *QueryResult) isLive(set map[string]metricStatus, key string, now time.Time) bool {
+	if _, ok := set[key]; ok {
+		return true
+	}
+	_, ok := r.Result[key]
+	return ok && r.isFresh(key, now)
+}
+
+// liveSeries counts the live metrics.
+func (r *QueryResult) liveSeries(set map[string]metricStatus, now time.Time) int {
+	n := len(set)
+	for key := range r.Result {
+		if _, ok := set[key]; !ok && r.isFresh(key, now) {
+			n++
+		}
+	}
+	return n
+}
+
+// isFresh reports whether a metric was set within the stale-after of the
+// query. Without a stale-after, metrics are never fresh once missing.
+func (r *QueryResult) isFresh(key string, now time.Time) bool {
+	if r.Query.StaleAfter == 0 {
+		return false
+	}
+	t, ok := r.updated[key]
+	return ok && now.Sub(t) <= r.Query.StaleAfter
+}
+
+func (r *QueryResult) setUpdated(key string, t time.Time) {
+	if r.updated == nil {
+		r.updated = make(map[string]time.Time)
+	}
+	r.updated[key] = t
+}
+
+func (r *QueryResult) unregisterStale(key string) {
+	fmt.Println("Unregistering metric", key)
+	prometheus.Unregister(r.Result[key])
+	delete(r.Result, key)
+	delete(r.updated, key)
+}
+
+func (r *QueryResult) RegisterMetrics(facetsWithResult map[string]metricStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Collect the changes first so stale metrics are unregistered before new
+	// ones with the same labels could be registered.
+	// With a stale-after, metrics missing from the result are kept until
+	// they were not set for that long.
+	now := time.Now()
+	var stale, fresh []string
+	for key := range r.Result {
+		status, ok := facetsWithResult[key]
+		if ok && r.Query.StaleAfter > 0 {
+			r.setUpdated(key, now)
+		}
+		if !ok && !r.isFresh(key, now) {
+			stale = append(stale, key)
+		} else if status == unregistered {
+			fresh = append(fresh, key)
+		}
+	}
+
+	for _, key := range stale {
+		r.unregisterStale(key)
+	}
+	for _, key := range fresh {
+		fmt.Println("Registering metric", key)
+		prometheus.MustRegister(r.Result[key])
 	}
+	r.seriesCount.Set(float64(len(r.Result)))
 }
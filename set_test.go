@@ -1,10 +1,17 @@
 package main
 
 import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
 )
 
 type testQuerySetOptions struct {
@@ -61,9 +68,9 @@ func TestSubMetrics(t *testing.T) {
 	(&testQuerySetOptions{
 		q: NewQueryResult(&Query{
 			Name: "submetrics_metric",
-			SubMetrics: map[string]string{
-				"total": "rt",
-				"count": "cnt",
+			SubMetrics: map[string]SubMetric{
+				"total": {Column: "rt"},
+				"count": {Column: "cnt"},
 			},
 		}),
 		rec: records{
@@ -115,6 +122,455 @@ gauge: <
 	}).testQuerySet(t)
 }
 
+func TestSubMetricsAsLabel(t *testing.T) {
+	(&testQuerySetOptions{
+		q: NewQueryResult(&Query{
+			Name:            "resources_metric",
+			SubMetricsLabel: "resource",
+			SubMetrics: map[string]SubMetric{
+				"cpu": {Column: "cpu"},
+				"mem": {Column: "mem"},
+			},
+		}),
+		rec: records{
+			record{
+				"cpu":  0.5,
+				"mem":  512,
+				"host": "a",
+			},
+		},
+		results: map[string]string{
+			`resources_metric{"host":"a","resource":"cpu"}`: `label: <
+  name: "host"
+  value: "a"
+>
+label: <
+  name: "resource"
+  value: "cpu"
+>
+gauge: <
+  value: 0.5
+>
+`,
+			`resources_metric{"host":"a","resource":"mem"}`: `label: <
+  name: "host"
+  value: "a"
+>
+label: <
+  name: "resource"
+  value: "mem"
+>
+gauge: <
+  value: 512
+>
+`,
+		},
+	}).testQuerySet(t)
+
+	q := &Query{Name: "q", SubMetricsLabel: "resource", SubMetrics: map[string]SubMetric{
+		"cpu": {Column: "cpu", Help: "CPU"},
+		"mem": {Column: "mem"},
+	}}
+	if err := validateSubMetricsLabel(q); err == nil {
+		t.Error("expected an error for sub-metrics with different help")
+	}
+}
+
+func TestSubMetricsLabels(t *testing.T) {
+	(&testQuerySetOptions{
+		q: NewQueryResult(&Query{
+			Name: "submetrics_labels_metric",
+			SubMetrics: map[string]SubMetric{
+				"total": {
+					Column: "rt",
+					Help:   "Total response time",
+					Labels: map[string]string{"unit": "ms"},
+				},
+			},
+		}),
+		rec: records{
+			record{
+				"rt":   200,
+				"name": "foo",
+			},
+		},
+		results: map[string]string{
+			`submetrics_labels_metric_total{"name":"foo"}`: `label: <
+  name: "name"
+  value: "foo"
+>
+label: <
+  name: "unit"
+  value: "ms"
+>
+gauge: <
+  value: 200
+>
+`,
+		},
+	}).testQuerySet(t)
+}
+
+func TestInfoMetric(t *testing.T) {
+	(&testQuerySetOptions{
+		q: NewQueryResult(&Query{
+			Name:       "db",
+			DataField:  "version",
+			InfoMetric: true,
+		}),
+		rec: records{
+			record{
+				"Version": "10.4",
+				"edition": "community",
+			},
+		},
+		results: map[string]string{
+			`db_info{"edition":"community","version":"10.4"}`: `label: <
+  name: "edition"
+  value: "community"
+>
+label: <
+  name: "version"
+  value: "10.4"
+>
+gauge: <
+  value: 1
+>
+`,
+		},
+	}).testQuerySet(t)
+}
+
+func TestLabelTransforms(t *testing.T) {
+	q := &Query{
+		Name:      "transform_metric",
+		DataField: "value",
+		LabelTransforms: map[string]*LabelTransform{
+			"Host":   {Trim: true, Regex: `^db-(\w+)\..*$`, Replacement: "$1"},
+			"region": {Case: CaseUpper},
+		},
+	}
+	if err := compileLabelTransforms(q); err != nil {
+		t.Fatal(err)
+	}
+
+	(&testQuerySetOptions{
+		q: NewQueryResult(q),
+		rec: records{
+			record{
+				"host":   " db-Primary.example.org ",
+				"region": "eu",
+				"value":  1,
+			},
+		},
+		results: map[string]string{
+			`transform_metric{"host":"primary","region":"EU"}`: `label: <
+  name: "host"
+  value: "primary"
+>
+label: <
+  name: "region"
+  value: "EU"
+>
+gauge: <
+  value: 1
+>
+`,
+		},
+	}).testQuerySet(t)
+}
+
+func TestUnitParse(t *testing.T) {
+	(&testQuerySetOptions{
+		q: NewQueryResult(&Query{
+			Name: "unit_metric",
+			SubMetrics: map[string]SubMetric{
+				"bytes":   {Column: "size", UnitParse: UnitParseBytes},
+				"seconds": {Column: "latency", UnitParse: UnitParseDuration},
+			},
+		}),
+		rec: records{
+			record{
+				"size":    "512MB",
+				"latency": "250ms",
+			},
+		},
+		results: map[string]string{
+			"unit_metric_bytes{}": `gauge: <
+  value: 5.12e+08
+>
+`,
+			"unit_metric_seconds{}": `gauge: <
+  value: 0.25
+>
+`,
+		},
+	}).testQuerySet(t)
+}
+
+func TestTimestampField(t *testing.T) {
+	measured := time.Now().Add(-time.Minute)
+	tests := []struct {
+		format string
+		value  interface{}
+	}{
+		{format: "", value: measured.Format(time.RFC3339)},
+		{format: TimestampFormatUnix, value: float64(measured.Unix())},
+	}
+	for _, tt := range tests {
+		q := NewQueryResult(&Query{
+			Name:            "timestamp_metric",
+			DataField:       "value",
+			TimestampField:  "measured_at",
+			TimestampFormat: tt.format,
+		})
+		_, err := q.SetMetrics(records{
+			record{
+				"name":        "foo",
+				"value":       67,
+				"measured_at": tt.value,
+			},
+		})
+		if err != nil {
+			t.Errorf("[%s] Error while setting metrics: %v", tt.format, err)
+			continue
+		}
+
+		if _, ok := q.Result[`timestamp_metric{"name":"foo"}`]; !ok {
+			t.Errorf("[%s] Can not find value metric.", tt.format)
+		}
+		m, ok := q.Result[`timestamp_metric_data_age_seconds{"name":"foo"}`]
+		if !ok {
+			t.Errorf("[%s] Can not find data age metric.", tt.format)
+			continue
+		}
+		metric := &dto.Metric{}
+		m.Write(metric)
+		if age := metric.GetGauge().GetValue(); age < 59 || age > 120 {
+			t.Errorf("[%s] bad data age ; got: %f", tt.format, age)
+		}
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	q := NewQueryResult(&Query{
+		Name:      "max_series_metric",
+		DataField: "value",
+		MaxSeries: 2,
+	})
+	rec := records{
+		record{"name": "foo", "value": 1},
+		record{"name": "bar", "value": 2},
+		record{"name": "baz", "value": 3},
+	}
+
+	list, err := q.SetMetrics(rec)
+	if err != nil {
+		t.Fatalf("Error while setting metrics: %v", err)
+	}
+	defer prometheus.Unregister(q.droppedSeries)
+
+	if len(q.Result) != 2 || len(list) != 2 {
+		t.Errorf("Bad number of result ; expected: 2, got: %d.", len(q.Result))
+	}
+
+	metric := &dto.Metric{}
+	q.droppedSeries.Write(metric)
+	if v := metric.GetCounter().GetValue(); v != 1 {
+		t.Errorf("Bad number of dropped series ; expected: 1, got: %f.", v)
+	}
+}
+
+func TestMaxSeriesRotation(t *testing.T) {
+	q := NewQueryResult(&Query{
+		Name:      "max_series_rotation_metric",
+		DataField: "value",
+		MaxSeries: 2,
+		Labels:    map[string]string{"source": "a"},
+	})
+	defer prometheus.Unregister(q.droppedSeries)
+	defer q.UnregisterMetrics()
+
+	fetch := func(rec records) {
+		list, err := q.SetMetrics(rec)
+		if err != nil {
+			t.Fatalf("Error while setting metrics: %v", err)
+		}
+		q.RegisterMetrics(list)
+	}
+	fetch(records{
+		record{"name": "a", "value": 1},
+		record{"name": "b", "value": 2},
+	})
+	fetch(records{
+		record{"name": "c", "value": 3},
+		record{"name": "d", "value": 4},
+		record{"name": "e", "value": 5},
+	})
+
+	got := map[string]bool{}
+	for k := range q.Metrics() {
+		got[k] = true
+	}
+	want := map[string]bool{
+		`max_series_rotation_metric{"name":"c"}`: true,
+		`max_series_rotation_metric{"name":"d"}`: true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Metrics = %v, want %v", got, want)
+	}
+
+	metric := &dto.Metric{}
+	q.droppedSeries.Write(metric)
+	if v := metric.GetCounter().GetValue(); v != 1 {
+		t.Errorf("Bad number of dropped series ; expected: 1, got: %f.", v)
+	}
+	if l := metric.GetLabel(); len(l) != 1 || l[0].GetName() != "source" {
+		t.Errorf("Dropped series labels = %v, want the labels of the query", l)
+	}
+}
+
+func TestMaxSeriesStaleAfter(t *testing.T) {
+	q := NewQueryResult(&Query{
+		Name:       "max_series_stale_metric",
+		DataField:  "value",
+		MaxSeries:  2,
+		StaleAfter: time.Hour,
+	})
+	defer prometheus.Unregister(q.droppedSeries)
+	defer q.UnregisterMetrics()
+
+	fetch := func(rec records) {
+		list, err := q.SetMetrics(rec)
+		if err != nil {
+			t.Fatalf("Error while setting metrics: %v", err)
+		}
+		q.RegisterMetrics(list)
+	}
+	fetch(records{
+		record{"name": "a", "value": 1},
+		record{"name": "b", "value": 2},
+	})
+	// The series kept by the stale-after count against the limit, a kept
+	// series is still set.
+	fetch(records{
+		record{"name": "c", "value": 3},
+		record{"name": "a", "value": 4},
+	})
+
+	got := map[string]bool{}
+	for k := range q.Metrics() {
+		got[k] = true
+	}
+	want := map[string]bool{
+		`max_series_stale_metric{"name":"a"}`: true,
+		`max_series_stale_metric{"name":"b"}`: true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Metrics = %v, want %v", got, want)
+	}
+	metric := &dto.Metric{}
+	q.Metrics()[`max_series_stale_metric{"name":"a"}`].Write(metric)
+	if v := metric.GetGauge().GetValue(); v != 4 {
+		t.Errorf("kept series value = %v, want 4", v)
+	}
+	q.droppedSeries.Write(metric)
+	if v := metric.GetCounter().GetValue(); v != 1 {
+		t.Errorf("Bad number of dropped series ; expected: 1, got: %f.", v)
+	}
+}
+
+func TestConcurrentQuerySet(t *testing.T) {
+	q := NewQueryResult(&Query{
+		Name:      "concurrent_metric",
+		DataField: "value",
+	})
+	rec := records{
+		record{"name": "foo", "value": 1},
+		record{"name": "bar", "value": 2},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				list, err := q.SetMetrics(rec)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				q.RegisterMetrics(list)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for _, m := range q.Metrics() {
+					m.Write(&dto.Metric{})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	m := q.Metrics()
+	if len(m) != 2 {
+		t.Errorf("Bad number of result ; expected: 2, got: %d.", len(m))
+	}
+	for _, g := range m {
+		prometheus.Unregister(g)
+	}
+}
+
+func TestRegisterMetricsDropsFacets(t *testing.T) {
+	q := NewQueryResult(&Query{
+		Name:      "dropped_facets_metric",
+		DataField: "value",
+	})
+
+	fetch := func(rec records) {
+		list, err := q.SetMetrics(rec)
+		if err != nil {
+			t.Fatalf("Error while setting metrics: %v", err)
+		}
+		q.RegisterMetrics(list)
+	}
+	fetch(records{
+		record{"name": "foo", "value": 1},
+		record{"name": "bar", "value": 2},
+	})
+	fetch(records{
+		record{"name": "foo", "value": 3},
+		record{"name": "baz", "value": 4},
+	})
+	defer func() {
+		for _, g := range q.Metrics() {
+			prometheus.Unregister(g)
+		}
+	}()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, f := range families {
+		if f.GetName() != "query_result_dropped_facets_metric" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			got[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+
+	want := map[string]float64{"foo": 3, "baz": 4}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Registered metrics = %v, want %v", got, want)
+	}
+}
+
 func (opts *testQuerySetOptions) testQuerySet(t *testing.T) {
 	_, err := opts.q.SetMetrics(opts.rec)
 	if err != nil {
@@ -144,3 +600,567 @@ func (opts *testQuerySetOptions) testQuerySet(t *testing.T) {
 	}
 
 }
+
+func TestValueColumnIndex(t *testing.T) {
+	index := 1
+	q := NewQueryResult(&Query{
+		Name:        "index_metric",
+		ValueColumn: &index,
+	})
+	rec := records{
+		record{"name": "foo", "count(*)": 3},
+		record{"name": "bar", "count(*)": 5},
+	}
+
+	if _, err := q.SetMetricsWithColumns(context.Background(), rec, []string{"name", "count(*)"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Result) != 2 {
+		t.Fatalf("results = %v", q.Result)
+	}
+	m := q.Result[`index_metric{"name":"bar"}`]
+	if m == nil {
+		t.Fatalf("missing metric, got %v", q.Result)
+	}
+	metric := &dto.Metric{}
+	m.Write(metric)
+	if v := metric.GetGauge().GetValue(); v != 5 {
+		t.Errorf("value = %v, want 5", v)
+	}
+
+	if _, err := q.SetMetricsWithColumns(context.Background(), rec, []string{"name"}); err == nil {
+		t.Error("expected an error for an out of range index")
+	}
+}
+
+func TestJSONNumber(t *testing.T) {
+	(&testQuerySetOptions{
+		q: NewQueryResult(&Query{
+			Name:      "number_metric",
+			DataField: "value",
+		}),
+		rec: records{
+			record{
+				"id":    json.Number("12345678901234567890"),
+				"value": json.Number("-42"),
+			},
+			record{
+				"id":    json.Number("9007199254740993"),
+				"value": json.Number("9007199254740992"),
+			},
+		},
+		results: map[string]string{
+			`number_metric{"id":"12345678901234567890"}`: `label: <
+  name: "id"
+  value: "12345678901234567890"
+>
+gauge: <
+  value: -42
+>
+`,
+			`number_metric{"id":"9007199254740993"}`: `label: <
+  name: "id"
+  value: "9007199254740993"
+>
+gauge: <
+  value: 9.007199254740992e+15
+>
+`,
+		},
+	}).testQuerySet(t)
+}
+
+func TestDecimalSeparator(t *testing.T) {
+	(&testQuerySetOptions{
+		q: NewQueryResult(&Query{
+			Name:       "decimal_metric",
+			DataField:  "value",
+			DecimalSep: DecimalSeparatorComma,
+		}),
+		rec: records{
+			record{"name": "grouped", "value": "1.234,56"},
+			record{"name": "plain", "value": "0,5"},
+		},
+		results: map[string]string{
+			`decimal_metric{"name":"grouped"}`: `label: <
+  name: "name"
+  value: "grouped"
+>
+gauge: <
+  value: 1234.56
+>
+`,
+			`decimal_metric{"name":"plain"}`: `label: <
+  name: "name"
+  value: "plain"
+>
+gauge: <
+  value: 0.5
+>
+`,
+		},
+	}).testQuerySet(t)
+}
+
+func TestMetricNamespace(t *testing.T) {
+	tests := []struct {
+		namespace string
+		subsystem string
+		noPrefix  bool
+		want      string
+	}{
+		{want: `fqName: "query_result_rows"`},
+		{namespace: "billing", subsystem: "db", want: `fqName: "billing_db_rows"`},
+		{namespace: "billing", want: `fqName: "billing_rows"`},
+		{noPrefix: true, want: `fqName: "rows"`},
+		{namespace: "billing", noPrefix: true, want: `fqName: "billing_rows"`},
+	}
+	for _, tt := range tests {
+		q := NewQueryResult(&Query{
+			Name:      "rows",
+			Namespace: tt.namespace,
+			Subsystem: tt.subsystem,
+		})
+		q.noDefaultPrefix = tt.noPrefix
+		if _, err := q.SetMetrics(records{record{"value": 1}}); err != nil {
+			t.Fatal(err)
+		}
+		if desc := q.Result["rows{}"].Desc().String(); !strings.Contains(desc, tt.want) {
+			t.Errorf("desc = %s, want %s", desc, tt.want)
+		}
+	}
+}
+
+func TestScaleOffset(t *testing.T) {
+	milli, zero := 0.001, 0.0
+	(&testQuerySetOptions{
+		q: NewQueryResult(&Query{
+			Name:   "scaled_metric",
+			Scale:  &milli,
+			Offset: 1,
+		}),
+		rec: records{
+			record{"value": 2500},
+		},
+		results: map[string]string{
+			"scaled_metric{}": `gauge: <
+  value: 3.5
+>
+`,
+		},
+	}).testQuerySet(t)
+
+	(&testQuerySetOptions{
+		q: NewQueryResult(&Query{
+			Name:   "zero_scaled_metric",
+			Scale:  &zero,
+			Offset: 1,
+		}),
+		rec: records{
+			record{"value": 2500},
+		},
+		results: map[string]string{
+			"zero_scaled_metric{}": `gauge: <
+  value: 1
+>
+`,
+		},
+	}).testQuerySet(t)
+}
+
+func TestRound(t *testing.T) {
+	two, zero, percent := 2, 0, 100.0
+	(&testQuerySetOptions{
+		q: NewQueryResult(&Query{
+			Name:  "rounded_metric",
+			Scale: &percent,
+			Round: &two,
+			SubMetrics: map[string]SubMetric{
+				"ratio": {Column: "ratio"},
+				"count": {Column: "count", Round: &zero},
+			},
+		}),
+		rec: records{
+			record{"ratio": 0.123456, "count": -0.025},
+		},
+		results: map[string]string{
+			"rounded_metric_ratio{}": `gauge: <
+  value: 12.35
+>
+`,
+			"rounded_metric_count{}": `gauge: <
+  value: -3
+>
+`,
+		},
+	}).testQuerySet(t)
+}
+
+func TestFilter(t *testing.T) {
+	rec := records{
+		record{"name": "foo", "active": 1, "state": "open", "value": 3},
+		record{"name": "bar", "active": 0, "state": "closed", "value": 5},
+		record{"name": "baz", "active": "1", "state": "open", "value": 7},
+	}
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{filter: "active = 1", want: []string{"foo", "baz"}},
+		{filter: "active != 1", want: []string{"bar"}},
+		{filter: "value >= 5", want: []string{"bar", "baz"}},
+		{filter: "state == 'closed'", want: []string{"bar"}},
+	}
+	for _, tt := range tests {
+		q := &Query{Name: "filter_metric", DataField: "value", Filter: tt.filter}
+		if err := compileFilter(q); err != nil {
+			t.Fatal(err)
+		}
+		r := NewQueryResult(q)
+		if _, err := r.SetMetrics(rec); err != nil {
+			t.Fatalf("[%s] %v", tt.filter, err)
+		}
+
+		var got []string
+		for _, row := range rec {
+			for key := range r.Result {
+				if strings.Contains(key, `"name":"`+row["name"].(string)+`"`) {
+					got = append(got, row["name"].(string))
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("[%s] rows = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	for _, filter := range []string{"active", "active =", "state > 'open'"} {
+		if err := compileFilter(&Query{Name: "invalid", Filter: filter}); err == nil {
+			t.Errorf("compileFilter(%q) returned no error", filter)
+		}
+	}
+}
+
+func TestExpression(t *testing.T) {
+	q := &Query{
+		Name:       "expr_metric",
+		Expression: "success_count / total_count",
+	}
+	if err := compileExpressions(q); err != nil {
+		t.Fatal(err)
+	}
+	(&testQuerySetOptions{
+		q: NewQueryResult(q),
+		rec: records{
+			record{"job": "import", "success_count": 3, "total_count": 4},
+		},
+		results: map[string]string{
+			`expr_metric{"job":"import"}`: `label: <
+  name: "job"
+  value: "import"
+>
+gauge: <
+  value: 0.75
+>
+`,
+		},
+	}).testQuerySet(t)
+
+	sq := &Query{
+		Name: "expr_sub_metric",
+		SubMetrics: map[string]SubMetric{
+			"ratio": {Expression: "(ok + 1) * 2 / -total"},
+			"total": {Column: "total"},
+		},
+	}
+	if err := compileExpressions(sq); err != nil {
+		t.Fatal(err)
+	}
+	r := NewQueryResult(sq)
+	if _, err := r.SetMetrics(records{record{"ok": "3", "total": 4}}); err != nil {
+		t.Fatal(err)
+	}
+	metric := &dto.Metric{}
+	r.Result["expr_sub_metric_ratio{}"].Write(metric)
+	if v := metric.GetGauge().GetValue(); v != -2 {
+		t.Errorf("value = %v, want -2", v)
+	}
+
+	// A zero divisor skips its row instead of exporting NaN or Inf.
+	zr := NewQueryResult(q)
+	list, err := zr.SetMetrics(records{
+		record{"job": "import", "success_count": 3, "total_count": 4},
+		record{"job": "export", "success_count": 0, "total_count": 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := list[`expr_metric{"job":"export"}`]; ok || len(list) != 1 {
+		t.Errorf("metrics = %v, want only the import row", list)
+	}
+
+	for _, expr := range []string{"a +", "(a", "a b", "1 / ", "a % b"} {
+		if _, err := compileExpr(expr); err == nil {
+			t.Errorf("compileExpr(%q) returned no error", expr)
+		}
+	}
+}
+
+func TestSetMetricsFailedRows(t *testing.T) {
+	exported := func(step string, r *QueryResult, key string) {
+		err := prometheus.Register(r.Metrics()[key])
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			t.Errorf("%s: %s is not exported, err=%v", step, key, err)
+		}
+	}
+
+	// A failed fetch forgets the metrics it created, so the next fetch
+	// registers them.
+	r := NewQueryResult(&Query{Name: "failed_fetch_metric", DataField: "value"})
+	defer r.UnregisterMetrics()
+	if _, err := r.SetMetrics(records{
+		record{"name": "a", "value": 1},
+		record{"name": "b", "value": "not a number"},
+	}); err == nil {
+		t.Fatal("expected an error for an invalid value")
+	}
+	if n := len(r.Metrics()); n != 0 {
+		t.Errorf("%d metrics kept after a failed fetch, want 0", n)
+	}
+	list, err := r.SetMetrics(records{record{"name": "a", "value": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RegisterMetrics(list)
+	exported("after failed fetch", r, `failed_fetch_metric{"name":"a"}`)
+
+	// A row dividing by zero is skipped, the others are exported.
+	q := &Query{
+		Name:       "failed_rows_metric",
+		Expression: "success_count / total_count",
+	}
+	if err := compileExpressions(q); err != nil {
+		t.Fatal(err)
+	}
+	r = NewQueryResult(q)
+	defer r.UnregisterMetrics()
+	for _, step := range []string{"zero divisor", "clean fetch"} {
+		recs := records{record{"job": "import", "success_count": 3, "total_count": 4}}
+		if step == "zero divisor" {
+			recs = append(recs, record{"job": "export", "success_count": 0, "total_count": 0})
+		}
+		list, err := r.SetMetrics(recs)
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		r.RegisterMetrics(list)
+		exported(step, r, `failed_rows_metric{"job":"import"}`)
+	}
+}
+
+func TestValueColumns(t *testing.T) {
+	q := NewQueryResult(&Query{
+		Name:         "host",
+		ValueColumns: []string{"cpu", "MEM"},
+	})
+	rec := records{
+		record{"host": "a", "cpu": 0.5, "mem": 1024},
+		record{"host": "b", "cpu": 0.25, "mem": 2048},
+	}
+	if _, err := q.SetMetrics(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{
+		`host_cpu{"host":"a"}`: 0.5,
+		`host_mem{"host":"a"}`: 1024,
+		`host_cpu{"host":"b"}`: 0.25,
+		`host_mem{"host":"b"}`: 2048,
+	}
+	if len(q.Result) != len(want) {
+		t.Fatalf("results = %v", q.Result)
+	}
+	for k, v := range want {
+		m := q.Result[k]
+		if m == nil {
+			t.Fatalf("missing metric %s, got %v", k, q.Result)
+		}
+		metric := &dto.Metric{}
+		m.Write(metric)
+		if got := metric.GetGauge().GetValue(); got != v {
+			t.Errorf("%s = %v, want %v", k, got, v)
+		}
+	}
+
+	if _, err := q.SetMetrics(records{record{"host": "c", "cpu": 1}}); err == nil {
+		t.Error("expected an error for a missing value column")
+	}
+}
+
+func TestLabelCase(t *testing.T) {
+	for _, tt := range []struct {
+		labelCase string
+		want      string
+	}{
+		{labelCase: "", want: `case_metric{"region":"eu-west"}`},
+		{labelCase: CaseUpper, want: `case_metric{"REGION":"EU-WEST"}`},
+		{labelCase: CasePreserve, want: `case_metric{"Region":"Eu-West"}`},
+	} {
+		r := NewQueryResult(&Query{Name: "case_metric", DataField: "value"})
+		r.labelCase = tt.labelCase
+		if _, err := r.SetMetrics(records{record{"Region": "Eu-West", "value": 1}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := r.Result[tt.want]; !ok {
+			t.Errorf("[%s] results = %v, want %s", tt.labelCase, r.Result, tt.want)
+		}
+	}
+}
+
+func TestColumns(t *testing.T) {
+	(&testQuerySetOptions{
+		q: NewQueryResult(&Query{
+			Name:    "mapped_metric",
+			Columns: map[string]string{"region": ColumnLabel, "Count": ColumnValue},
+		}),
+		rec: records{
+			record{"region": "eu", "count": 3, "comment": "not a label"},
+		},
+		results: map[string]string{
+			`mapped_metric{"region":"eu"}`: `label: <
+  name: "region"
+  value: "eu"
+>
+gauge: <
+  value: 3
+>
+`,
+		},
+	}).testQuerySet(t)
+}
+
+func TestSkipZero(t *testing.T) {
+	r := NewQueryResult(&Query{Name: "sparse_metric", DataField: "value", SkipZero: true})
+	facets, err := r.SetMetrics(records{
+		record{"state": "open", "value": 2},
+		record{"state": "closed", "value": 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RegisterMetrics(facets)
+	if _, ok := r.Result[`sparse_metric{"state":"open"}`]; !ok || len(r.Result) != 1 {
+		t.Fatalf("results = %v, want only the open state", r.Result)
+	}
+
+	facets, err = r.SetMetrics(records{
+		record{"state": "open", "value": "0"},
+		record{"state": "closed", "value": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RegisterMetrics(facets)
+	if _, ok := r.Result[`sparse_metric{"state":"closed"}`]; !ok || len(r.Result) != 1 {
+		t.Errorf("results = %v, want only the closed state", r.Result)
+	}
+	r.UnregisterMetrics()
+}
+
+func TestValueAsLabel(t *testing.T) {
+	r := NewQueryResult(&Query{Name: "status_metric", DataField: "status", ValueAsLabel: true})
+	defer r.UnregisterMetrics()
+	set := func(status string) {
+		facets, err := r.SetMetrics(records{record{"service": "api", "status": status}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RegisterMetrics(facets)
+	}
+
+	set("healthy")
+	key := `status_metric{"service":"api","status":"healthy"}`
+	m, ok := r.Result[key]
+	if !ok || len(r.Result) != 1 {
+		t.Fatalf("results = %v, want %s", r.Result, key)
+	}
+	metric := &dto.Metric{}
+	m.Write(metric)
+	if v := metric.GetGauge().GetValue(); v != 1 {
+		t.Errorf("value = %v, want 1", v)
+	}
+
+	set("degraded")
+	if _, ok := r.Result[`status_metric{"service":"api","status":"degraded"}`]; !ok || len(r.Result) != 1 {
+		t.Errorf("results = %v, want only the degraded status", r.Result)
+	}
+}
+
+func TestStaleAfter(t *testing.T) {
+	r := NewQueryResult(&Query{Name: "stale_metric", DataField: "value", StaleAfter: time.Hour})
+	set := func(recs records) {
+		facets, err := r.SetMetrics(recs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RegisterMetrics(facets)
+	}
+	defer r.UnregisterMetrics()
+
+	set(records{record{"page": "1", "value": 1}})
+	set(records{record{"page": "2", "value": 2}})
+	if len(r.Result) != 2 {
+		t.Fatalf("results = %v, want both pages", r.Result)
+	}
+
+	r.updated[`stale_metric{"page":"1"}`] = time.Now().Add(-2 * time.Hour)
+	r.SweepStale()
+	if _, ok := r.Result[`stale_metric{"page":"2"}`]; !ok || len(r.Result) != 1 {
+		t.Errorf("results = %v, want only page 2", r.Result)
+	}
+}
+
+func TestSeriesCount(t *testing.T) {
+	r := NewQueryResult(&Query{Name: "counted_metric", DataField: "value", StaleAfter: time.Hour})
+	defer r.UnregisterMetrics()
+	count := func() float64 {
+		metric := &dto.Metric{}
+		r.seriesCount.Write(metric)
+		return metric.GetGauge().GetValue()
+	}
+
+	facets, err := r.SetMetrics(records{
+		record{"page": "1", "value": 1},
+		record{"page": "2", "value": 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RegisterMetrics(facets)
+	if c := count(); c != 2 {
+		t.Errorf("series count = %v, want 2", c)
+	}
+
+	r.updated[`counted_metric{"page":"1"}`] = time.Now().Add(-2 * time.Hour)
+	r.SweepStale()
+	if c := count(); c != 1 {
+		t.Errorf("series count = %v, want 1 after sweeping", c)
+	}
+}
+
+func TestSetMetricsAborted(t *testing.T) {
+	r := NewQueryResult(&Query{Name: "aborted_metric", DataField: "value"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := r.SetMetricsWithColumns(ctx, records{
+		record{"page": "1", "value": 1},
+		record{"page": "2", "value": 2},
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "after 0 of 2 rows") {
+		t.Errorf("SetMetricsWithColumns() error = %v, want aborted", err)
+	}
+	if len(r.Result) != 0 {
+		t.Errorf("results = %v, want none", r.Result)
+	}
+}
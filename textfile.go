@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// TextfileName is the file written to the -textfile-dir.
+const TextfileName = "prometheus_sql.prom"
+
+// TextfileWriter writes the metrics to a file for the textfile collector of
+// node_exporter. Fetches notify the writer, which rewrites the file once per
+// notification burst.
+type TextfileWriter struct {
+	path   string
+	notify chan struct{}
+}
+
+// NewTextfileWriter creates a writer of the metrics file in dir.
+func NewTextfileWriter(dir string) *TextfileWriter {
+	return &TextfileWriter{
+		path:   filepath.Join(dir, TextfileName),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Notify requests the file to be written, without blocking the caller.
+func (t *TextfileWriter) Notify() {
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run writes the file on each notification until the context is done.
+func (t *TextfileWriter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.notify:
+			if err := t.Write(); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+// Write renders the metrics to a temporary file in the same directory and
+// renames it, so the collector never reads a partial file.
+func (t *TextfileWriter) Write() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(t.path), "."+TextfileName+".")
+	if err != nil {
+		return fmt.Errorf("Error creating textfile: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := writeMetrics(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error writing textfile: %s", err)
+	}
+	// Temporary files are only readable by their owner.
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("Error writing textfile: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), t.path); err != nil {
+		return fmt.Errorf("Error writing textfile: %s", err)
+	}
+	return nil
+}
@@ -2,17 +2,27 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"mime"
 	"net/http"
-	"os"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/jpillora/backoff"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 )
 
@@ -27,17 +37,168 @@ var defaultBackoff = backoff.Backoff{
 }
 
 type Worker struct {
-	query   *Query
-	payload []byte
-	client  *http.Client
-	result  *QueryResult
-	log     *log.Logger
-	backoff backoff.Backoff
-	ctx     context.Context
+	query     *Query
+	payloads  [][]byte            // One per data source, the primary first
+	headers   []map[string]string // Accept headers per payload
+	client    *http.Client
+	result    *QueryResult
+	log       *log.Logger
+	backoff   backoff.Backoff
+	attempts  int // Backoff durations taken since the last reset
+	ctx       context.Context
+	lastFetch time.Time
+	userAgent string
+
+	maxResponseBytes int64
+	noInitialTick    bool
+
+	// onFirstFetch is called once after the first successful fetch.
+	onFirstFetch func()
+	// onFetch is called after each fetch, whether it succeeded or not.
+	onFetch func()
+
+	// RecordTransformer, if set, modifies the decoded records of each fetch
+	// before the metrics are set, e.g. to pivot or filter them in Go when
+	// embedding the worker.
+	RecordTransformer func(records) (records, error)
+
+	failures            int
+	consecutiveFailures prometheus.Gauge
+	fetchInProgress     prometheus.Gauge
+	panics              prometheus.Counter
+	heartbeat           prometheus.Counter
+	payloadBytes        prometheus.Gauge
+	lastError           *prometheus.GaugeVec
+	lastErr             string
+
+	// The duration of fetches is either a gauge of the last fetch or a
+	// histogram of all fetches.
+	fetchDuration          prometheus.Gauge
+	fetchDurationHistogram prometheus.Histogram
+
+	// The circuit breaker skips ticks until circuitOpenUntil after the
+	// configured number of consecutive failed ticks. The next failure after
+	// that opens it again, a success closes it.
+	failedTicks      int
+	circuitOpenUntil time.Time
+	up               prometheus.Gauge
+
+	// fast is set while the threshold column of the last result exceeds the
+	// threshold, fetching at the fast interval.
+	fast bool
+	// intervalSeconds is the interval until the next tick, with jitter.
+	intervalSeconds prometheus.Gauge
+}
+
+// backoffDuration returns the next backoff duration.
+func (w *Worker) backoffDuration() time.Duration {
+	w.attempts++
+	return w.backoff.Duration()
+}
+
+// resetBackoff resets the backoff after a successful fetch, fully or by one
+// attempt depending on the backoff-reset of the query.
+func (w *Worker) resetBackoff() {
+	w.backoff.Reset()
+	if w.query.BackoffReset != BackoffResetSoft || w.attempts == 0 {
+		w.attempts = 0
+		return
+	}
+
+	// The backoff can only be reset to zero, so replay the kept attempts.
+	w.attempts--
+	for i := 0; i < w.attempts; i++ {
+		w.backoff.Duration()
+	}
+}
+
+// registerGauge registers a gauge, returning the already registered one if an
+// identical gauge exists, e.g. for queries sharing a metric name.
+func registerGauge(g prometheus.Gauge) prometheus.Gauge {
+	if err := prometheus.Register(g); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(prometheus.Gauge)
+		}
+		panic(err)
+	}
+	return g
+}
+
+// registerCounter is registerGauge for counters.
+func registerCounter(c prometheus.Counter) prometheus.Counter {
+	if err := prometheus.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(prometheus.Counter)
+		}
+		panic(err)
+	}
+	return c
+}
+
+// registerHistogram is registerGauge for histograms.
+func registerHistogram(h prometheus.Histogram) prometheus.Histogram {
+	if err := prometheus.Register(h); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(prometheus.Histogram)
+		}
+		panic(err)
+	}
+	return h
+}
+
+// registerGaugeVec is registerGauge for gauge vectors.
+func registerGaugeVec(g *prometheus.GaugeVec) *prometheus.GaugeVec {
+	if err := prometheus.Register(g); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(*prometheus.GaugeVec)
+		}
+		panic(err)
+	}
+	return g
+}
+
+// errCanceled is returned when a fetch is aborted by the worker's context.
+var errCanceled = errors.New("Execution was canceled")
+
+// errResponseTooLarge is returned when a response body exceeds the limit.
+var errResponseTooLarge = errors.New("Response body exceeds the maximum size")
+
+// limitedReader reads up to max bytes and fails with errResponseTooLarge once
+// the underlying reader has more data.
+type limitedReader struct {
+	r    io.Reader
+	read int64
+	max  int64
+}
+
+func newLimitedReader(r io.Reader, max int64) *limitedReader {
+	return &limitedReader{r: io.LimitReader(r, max+1), max: max}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.max {
+		return n, errResponseTooLarge
+	}
+	return n, err
 }
 
 func (w *Worker) SetMetrics(recs records) {
-	list, err := w.result.SetMetrics(recs)
+	w.setMetrics(recs, nil)
+}
+
+func (w *Worker) setMetrics(recs records, columns []string) {
+	// Huge results are given up on after the process-timeout rather than
+	// blocking the worker.
+	ctx := w.ctx
+	if w.query.ProcessTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.query.ProcessTimeout)
+		defer cancel()
+	}
+
+	list, err := w.result.SetMetricsWithColumns(ctx, recs, columns)
 	if err != nil {
 		w.log.Printf("Error setting metrics: %s", err)
 		return
@@ -54,27 +215,50 @@ func (w *Worker) Fetch(url string) (records, error) {
 		resp *http.Response
 	)
 
+	// A fetch stuck in progress shows up as a gauge stuck at 1.
+	w.fetchInProgress.Set(1)
+	defer w.fetchInProgress.Set(0)
+
+	// Protect the backend from rapid refetching, e.g. during restarts.
+	if w.query.MinFetchGap > 0 && !w.lastFetch.IsZero() {
+		if since := time.Since(w.lastFetch); since < w.query.MinFetchGap {
+			w.log.Printf("Skipping fetch, last fetch was %s ago", since)
+			return nil, nil
+		}
+	}
+
+	start := time.Now()
+	source := 0
 	for {
 		t = time.Now()
 
-		req, err = http.NewRequest("POST", url, bytes.NewBuffer(w.payload))
+		req, err = http.NewRequest("POST", url, bytes.NewBuffer(w.payloads[source]))
 
+		// A bad URL won't get any better by retrying.
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("Error creating request: %s", err)
 		}
 		req = req.WithContext(w.ctx)
 
 		// Set the content-type of the request body and accept LD-JSON.
 		req.Header.Set("content-type", "application/json")
 		req.Header.Set("accept", "application/json")
+		req.Header.Set("user-agent", w.userAgent)
+		for k, v := range w.headers[source] {
+			req.Header.Set(k, v)
+		}
 
 		resp, err = w.client.Do(req)
 
 		// No formal error, but a non-successful status code. Construct an error.
+		var retryAfter time.Duration
 		if err == nil && resp.StatusCode != 200 {
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+				retryAfter = parseRetryAfter(resp.Header.Get("retry-after"), time.Now())
+			}
 			b, _ := ioutil.ReadAll(resp.Body)
 			resp.Body.Close()
-			err = fmt.Errorf("%s: %s", resp.Status, string(b))
+			err = fmt.Errorf("%s: %s", resp.Status, errorMessage(resp.Header.Get("content-type"), b))
 		}
 
 		// No error, break to read the data.
@@ -82,92 +266,772 @@ func (w *Worker) Fetch(url string) (records, error) {
 			break
 		}
 
-		if w.query.ValueOnError != "" {
-			w.SetMetrics([]record{
-				map[string]interface{}{
-					"error": w.query.ValueOnError,
-				},
-			})
+		// Try the next data source of the chain before backing off.
+		if source+1 < len(w.payloads) {
+			w.log.Print(err)
+			source++
+			w.log.Printf("Falling back to data source [%s]", w.query.FallbackRefs[source-1])
+			continue
 		}
+		source = 0
 
-		// Backoff on an error.
 		w.log.Print(err)
-		d := w.backoff.Duration()
+		w.attemptFailed(err)
+
+		// Backoff on an error.
+		d := w.backoffDuration()
+		if retryAfter > 0 {
+			d = retryAfter
+			if d > w.backoff.Max {
+				d = w.backoff.Max
+			}
+		}
+		// With a circuit breaker the tick fails once its retries would run
+		// into the next one.
+		if w.query.CircuitFailures > 0 && time.Since(start)+d >= w.query.Interval {
+			return nil, w.tickFailed(err)
+		}
 		w.log.Printf("Backing off for %s", d)
 		select {
 		case <-time.After(d):
 			continue
 		case <-w.ctx.Done():
-			return nil, errors.New("Execution was canceled")
+			return nil, errCanceled
 		}
 	}
 
-	w.backoff.Reset()
+	var (
+		recs    []record
+		columns []string
+		body    io.Reader = resp.Body
+	)
+
+	defer resp.Body.Close()
+
+	if w.maxResponseBytes > 0 {
+		body = newLimitedReader(resp.Body, w.maxResponseBytes)
+	}
+
+	// The body read is bound to the request context, so a cancellation
+	// aborts the decode as well.
+	if contentType := resp.Header.Get("content-type"); isLDJSON(contentType) {
+		recs, columns, err = decodeLDJSON(body)
+	} else if isCSV(contentType) {
+		recs, columns, err = decodeCSV(body)
+	} else if w.query.ValueColumn != nil {
+		recs, columns, err = decodeWithColumns(body)
+	} else {
+		err = newDecoder(body).Decode(&recs)
+	}
+	if err != nil {
+		if w.ctx.Err() != nil {
+			return nil, errCanceled
+		}
+		w.attemptFailed(err)
+		return nil, w.tickFailed(err)
+	}
+	if w.RecordTransformer != nil {
+		if recs, err = w.RecordTransformer(recs); err != nil {
+			err = fmt.Errorf("Error transforming records: %s", err)
+			w.attemptFailed(err)
+			return nil, w.tickFailed(err)
+		}
+	}
+
+	// Only a decoded result counts as a success.
+	w.resetBackoff()
+	w.failures = 0
+	w.failedTicks = 0
+	w.consecutiveFailures.Set(0)
+	w.up.Set(1)
 
 	w.log.Printf("Fetch took %s", time.Now().Sub(t))
+	w.observeFetchDuration(time.Since(t))
 
-	var recs []record
+	w.lastFetch = time.Now()
+	w.setMetrics(recs, columns)
+	w.setLastError(nil)
 
-	defer resp.Body.Close()
+	return recs, nil
+}
+
+// newDecoder decodes numbers as json.Number so large integers keep their
+// precision until they are set.
+func newDecoder(r io.Reader) *json.Decoder {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return dec
+}
+
+// decodeWithColumns decodes records and the column order of the first
+// record, which is lost when decoding into a map.
+func decodeWithColumns(r io.Reader) (records, []string, error) {
+	var raw []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+
+	recs := make(records, len(raw))
+	for i, m := range raw {
+		if err := newDecoder(bytes.NewReader(m)).Decode(&recs[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(raw) == 0 {
+		return recs, nil, nil
+	}
+
+	columns, err := columnOrder(raw[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return recs, columns, nil
+}
+
+// isLDJSON reports whether a content type is line-delimited JSON.
+func isLDJSON(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch t {
+	case "application/x-ldjson", "application/x-ld-json", "application/x-ndjson":
+		return true
+	}
+	return false
+}
+
+// isCSV reports whether a content type is CSV.
+func isCSV(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	return err == nil && t == "text/csv"
+}
+
+// decodeCSV decodes records from CSV with a header row. Values are strings
+// and parsed when they are set.
+func decodeCSV(r io.Reader) (records, []string, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	recs := make(records, 0, len(rows))
+	if len(rows) == 0 {
+		return recs, nil, nil
+	}
+
+	columns := rows[0]
+	for _, row := range rows[1:] {
+		rec := make(record, len(columns))
+		for i, c := range columns {
+			rec[c] = row[i]
+		}
+		recs = append(recs, rec)
+	}
+
+	return recs, columns, nil
+}
+
+// decodeLDJSON decodes records given as a stream of JSON objects, one per
+// line, and the column order of the first record.
+func decodeLDJSON(r io.Reader) (records, []string, error) {
+	var (
+		recs    = make(records, 0)
+		columns []string
+	)
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		var rec record
+		if err := newDecoder(bytes.NewReader(raw)).Decode(&rec); err != nil {
+			return nil, nil, err
+		}
+		if len(recs) == 0 {
+			var err error
+			if columns, err = columnOrder(raw); err != nil {
+				return nil, nil, err
+			}
+		}
+		recs = append(recs, rec)
+	}
 
-	if err = json.NewDecoder(resp.Body).Decode(&recs); err != nil {
+	return recs, columns, nil
+}
+
+// columnOrder returns the keys of a JSON object in the order they appear.
+func columnOrder(obj json.RawMessage) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(obj))
+	if _, err := dec.Token(); err != nil {
 		return nil, err
 	}
 
-	w.SetMetrics(recs)
+	var columns []string
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, t.(string))
+
+		// Skip the value.
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+	}
 
-	return recs, nil
+	return columns, nil
+}
+
+// errorMessage returns the message of an error response. A JSON body with a
+// message field gives the message and its code, otherwise the raw body is
+// returned.
+func errorMessage(contentType string, body []byte) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil || t != "application/json" && !strings.HasSuffix(t, "+json") {
+		return string(body)
+	}
+
+	var e struct {
+		Message string      `json:"message"`
+		Code    interface{} `json:"code"`
+	}
+	if err := json.Unmarshal(body, &e); err != nil || e.Message == "" {
+		return string(body)
+	}
+	if e.Code != nil {
+		return fmt.Sprintf("%s (code %v)", e.Message, e.Code)
+	}
+	return e.Message
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP
+// date. Zero is returned if the header is missing or invalid.
+func parseRetryAfter(h string, now time.Time) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// observeFetchDuration records the duration of a successful fetch.
+func (w *Worker) observeFetchDuration(d time.Duration) {
+	if w.fetchDurationHistogram != nil {
+		w.fetchDurationHistogram.Observe(d.Seconds())
+		return
+	}
+	w.fetchDuration.Set(d.Seconds())
+}
+
+// attemptFailed accounts for a failed attempt of a fetch.
+func (w *Worker) attemptFailed(err error) {
+	w.failures++
+	w.consecutiveFailures.Set(float64(w.failures))
+	w.setLastError(err)
+	w.result.SweepStale()
+
+	w.setValueOnError()
+}
+
+// tickFailed accounts for a tick whose fetch failed and returns its error,
+// or the error of opening the circuit breaker.
+func (w *Worker) tickFailed(err error) error {
+	w.failedTicks++
+	if w.openCircuit() {
+		return fmt.Errorf("Circuit opened after %d consecutive failed fetches, skipping fetches until %s", w.failedTicks, w.circuitOpenUntil.Format(time.RFC3339))
+	}
+	return err
+}
+
+// openCircuit opens the circuit breaker once the consecutive failed ticks
+// reach the configured number. The cooldown defaults to the query interval.
+func (w *Worker) openCircuit() bool {
+	if w.query.CircuitFailures == 0 || w.failedTicks < w.query.CircuitFailures {
+		return false
+	}
+
+	cooldown := w.query.CircuitCooldown
+	if cooldown == 0 {
+		cooldown = w.query.Interval
+	}
+	w.circuitOpenUntil = time.Now().Add(cooldown)
+	w.up.Set(0)
+	return true
+}
+
+// circuitOpen reports whether fetches are skipped by the circuit breaker.
+// After the cooldown the circuit is half open, one fetch probes the agent.
+func (w *Worker) circuitOpen() bool {
+	return time.Now().Before(w.circuitOpenUntil)
 }
 
-func (w *Worker) Start(url string) {
+// maxLastErrorLength bounds the runes of the error label of the last error metric, errors
+// may include the whole response of sql-agent.
+const maxLastErrorLength = 256
+
+// setLastError exposes the error of the last failed fetch, or clears it
+// with a nil error.
+func (w *Worker) setLastError(err error) {
+	w.lastError.Reset()
+	if err == nil {
+		w.lastErr = ""
+		return
+	}
+
+	w.lastErr = err.Error()
+	// Converting to runes replaces invalid UTF-8, which labels must not hold.
+	msg := []rune(w.lastErr)
+	if len(msg) > maxLastErrorLength {
+		msg = msg[:maxLastErrorLength]
+	}
+	w.lastError.WithLabelValues(string(msg)).Set(1)
+}
+
+// setValueOnError sets the metrics to the value-on-error of the query, if any.
+func (w *Worker) setValueOnError() {
+	if w.query.ValueOnError != "" {
+		rec := record{w.query.errorField(): w.query.ValueOnError}
+		for k, v := range w.query.ErrorLabels {
+			rec[k] = v
+		}
+		w.SetMetrics(records{rec})
+	}
+}
+
+// unregisterMetrics removes all metrics of the worker from the registry.
+func (w *Worker) unregisterMetrics() {
+	w.result.UnregisterMetrics()
+	prometheus.Unregister(w.consecutiveFailures)
+	prometheus.Unregister(w.fetchInProgress)
+	prometheus.Unregister(w.panics)
+	prometheus.Unregister(w.heartbeat)
+	if w.fetchDurationHistogram != nil {
+		prometheus.Unregister(w.fetchDurationHistogram)
+	} else {
+		prometheus.Unregister(w.fetchDuration)
+	}
+	prometheus.Unregister(w.payloadBytes)
+	prometheus.Unregister(w.lastError)
+	prometheus.Unregister(w.up)
+	prometheus.Unregister(w.intervalSeconds)
+}
+
+// Start fetches the query from the service at each interval until the
+// context of the worker is done, then marks the worker done in wg.
+func (w *Worker) Start(url string, wg *sync.WaitGroup) {
+	// Metrics are registered while the worker runs so reloaded workers
+	// replace them cleanly.
+	w.consecutiveFailures = registerGauge(w.consecutiveFailures)
+	w.fetchInProgress = registerGauge(w.fetchInProgress)
+	w.panics = registerCounter(w.panics)
+	w.heartbeat = registerCounter(w.heartbeat)
+	if w.fetchDurationHistogram != nil {
+		w.fetchDurationHistogram = registerHistogram(w.fetchDurationHistogram)
+	} else {
+		w.fetchDuration = registerGauge(w.fetchDuration)
+	}
+	w.payloadBytes = registerGauge(w.payloadBytes)
+	w.result.seriesCount = registerGauge(w.result.seriesCount)
+	w.intervalSeconds = registerGauge(w.intervalSeconds)
+	w.lastError = registerGaugeVec(w.lastError)
+	if w.query.CircuitFailures > 0 {
+		w.up = registerGauge(w.up)
+	}
+
 	tick := func() {
-		_, err := w.Fetch(url)
+		w.heartbeat.Inc()
+
+		// A panic fails this tick only, the next tick runs as usual.
+		defer func() {
+			if r := recover(); r != nil {
+				w.panics.Inc()
+				w.log.Printf("Recovered from panic: %v\n%s", r, debug.Stack())
+			}
+		}()
+
+		if w.circuitOpen() {
+			w.log.Printf("Circuit open, skipping fetch until %s", w.circuitOpenUntil.Format(time.RFC3339))
+			// Metrics still go stale during an outage.
+			w.result.SweepStale()
+			if w.onFetch != nil {
+				w.onFetch()
+			}
+			return
+		}
+
+		recs, err := w.Fetch(url)
+		w.result.SweepStale()
+		if w.onFetch != nil {
+			w.onFetch()
+		}
 		if err != nil {
 			w.log.Printf("Error fetching records: %s", err)
 			return
 		}
+		if recs != nil {
+			w.adaptInterval(recs)
+		}
+		if w.onFirstFetch != nil {
+			w.onFirstFetch()
+			w.onFirstFetch = nil
+		}
 	}
 
-	tick()
-	ticker := time.NewTicker(w.query.Interval)
+	if !w.noInitialTick {
+		tick()
+	}
+
+	// A timer reset after each tick instead of a ticker, so the jitter
+	// keeps queries with the same interval from staying in phase.
+	timer := time.NewTimer(w.nextInterval())
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-w.ctx.Done():
-			wg, _ := w.ctx.Value("wg").(*sync.WaitGroup)
+			w.unregisterMetrics()
 			wg.Done()
 			w.log.Printf("Stopping worker")
 			return
 
-		case <-ticker.C:
+		case <-timer.C:
+			// Count the fetch time into the interval, like a ticker does.
+			start := time.Now()
 			tick()
+			timer.Reset(w.nextInterval() - time.Since(start))
 		}
 	}
 }
 
-// NewWorker creates a new worker for a query.
-func NewWorker(ctx context.Context, q *Query) *Worker {
-	// Encode the payload once for all subsequent requests.
-	payload, err := json.Marshal(map[string]interface{}{
-		"driver":     q.Driver,
-		"connection": q.Connection,
+// interval returns the time until the next fetch. With a fast-interval it
+// depends on the last result, the slow interval defaults to the interval.
+func (w *Worker) interval() time.Duration {
+	if w.query.FastInterval == 0 {
+		return w.query.Interval
+	}
+	if w.fast {
+		return w.query.FastInterval
+	}
+	if w.query.SlowInterval > 0 {
+		return w.query.SlowInterval
+	}
+	return w.query.Interval
+}
+
+// nextInterval returns the interval until the next tick with jitter and
+// exposes it.
+func (w *Worker) nextInterval() time.Duration {
+	d := jitter(w.interval(), w.query.IntervalJitter)
+	w.intervalSeconds.Set(d.Seconds())
+	return d
+}
+
+// adaptInterval switches to the fast interval when the threshold column of
+// any row exceeds the threshold, and back to the slow one otherwise.
+func (w *Worker) adaptInterval(recs records) {
+	if w.query.ThresholdColumn == "" {
+		return
+	}
+
+	fast := false
+	for _, row := range recs {
+		for k, v := range row {
+			if strings.ToLower(k) != strings.ToLower(w.query.ThresholdColumn) {
+				continue
+			}
+			f, err := parseValue(v, "", w.query.DecimalSep)
+			if err != nil {
+				w.log.Printf("Error parsing threshold column: %s", err)
+				continue
+			}
+			if f > w.query.Threshold {
+				fast = true
+			}
+		}
+	}
+	if fast != w.fast {
+		w.fast = fast
+		w.log.Printf("Switching to an interval of %s", w.interval())
+	}
+}
+
+// jitter randomly shortens or lengthens the interval by up to the given
+// percentage.
+func jitter(d time.Duration, percent float64) time.Duration {
+	if percent <= 0 {
+		return d
+	}
+	f := (rand.Float64()*2 - 1) * percent / 100
+	return d + time.Duration(f*float64(d))
+}
+
+// defaultUserAgent identifies requests to sql-agent as coming from this
+// service. Only the commit of the build version is used.
+func defaultUserAgent() string {
+	version := buildVersion
+	if f := strings.Fields(version); len(f) > 0 {
+		version = f[0]
+	}
+	return fmt.Sprintf("prometheus-sql/%s", version)
+}
+
+// newPayloadTemplate parses a payload template. The json function encodes a
+// value as JSON, e.g. {"query": {{json .sql}}}.
+func newPayloadTemplate(text string) (*template.Template, error) {
+	return template.New("payload").Option("missingkey=zero").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+}
+
+// encodePayload encodes the request to sql-agent for a query against a
+// data source. With a template the fields of the default payload are
+// reshaped by it, e.g. for agents expecting other field names.
+func encodePayload(q *Query, driver string, connection map[string]interface{}, tmpl *template.Template) ([]byte, error) {
+	fields := map[string]interface{}{
+		"driver":     driver,
+		"connection": connection,
 		"sql":        q.SQL,
 		"params":     q.Params,
-	})
+	}
+	// Transaction hints are only sent when set, agents may ignore them.
+	if q.ReadOnly {
+		fields["read_only"] = true
+	}
+	if q.Isolation != "" {
+		fields["isolation"] = q.Isolation
+	}
+	if tmpl != nil {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, fields); err != nil {
+			return nil, fmt.Errorf("Error executing payload template for query [%s]: %s", q.Name, err)
+		}
+		if !json.Valid(buf.Bytes()) {
+			return nil, fmt.Errorf("Payload template for query [%s] is not valid JSON: %s", q.Name, buf.String())
+		}
+		return buf.Bytes(), nil
+	}
 
+	payload, err := json.Marshal(fields)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("Error encoding payload for query [%s]: %s", q.Name, err)
 	}
+	return payload, nil
+}
 
-	return &Worker{
-		query:   q,
-		result:  NewQueryResult(q),
-		payload: payload,
-		backoff: defaultBackoff,
-		log:     log.New(os.Stderr, fmt.Sprintf("[%s] ", q.Name), log.LstdFlags),
-		client: &http.Client{
-			Timeout: q.Timeout,
-		},
-		ctx: ctx,
+// newAgentClient creates a client to talk to sql-agent with the protocol and
+// proxy of the configuration.
+func newAgentClient(c *Config, timeout time.Duration) (*http.Client, error) {
+	var proxy *url.URL
+	if c.ProxyURL != "" {
+		var err error
+		if proxy, err = url.Parse(c.ProxyURL); err != nil {
+			return nil, fmt.Errorf("Invalid proxy-url: %s", err)
+		}
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: newTransport(c.AgentProtocol, proxy),
+	}, nil
+}
+
+// newTransport returns the transport to talk to sql-agent with the given
+// protocol and proxy, nil for the default transport negotiating it and
+// using the proxy of the environment.
+func newTransport(protocol string, proxy *url.URL) http.RoundTripper {
+	switch protocol {
+	case AgentProtocolHTTP1:
+		t := newAgentTransport(proxy)
+		// A non-nil empty map disables HTTP/2.
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		return t
+	case AgentProtocolHTTP2:
+		return http2Transport{newAgentTransport(proxy)}
+	}
+	if proxy != nil {
+		return newAgentTransport(proxy)
+	}
+	return nil
+}
+
+// newAgentTransport creates a transport like the default one, using the
+// given proxy if any. It sets no dialer since that would disable HTTP/2.
+func newAgentTransport(proxy *url.URL) *http.Transport {
+	proxyFunc := http.ProxyFromEnvironment
+	if proxy != nil {
+		proxyFunc = http.ProxyURL(proxy)
+	}
+	return &http.Transport{
+		Proxy:                 proxyFunc,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// http2Transport fails requests which weren't answered over HTTP/2. HTTP/2
+// is negotiated over TLS, so the service must be an https URL.
+type http2Transport struct {
+	*http.Transport
+}
+
+func (t http2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ProtoMajor != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Expected an HTTP/2 response from %s, got %s", req.URL, resp.Proto)
+	}
+	return resp, nil
+}
+
+// fetchDurationBuckets range from 10ms to about 80s, queries may well take
+// longer than the default buckets.
+var fetchDurationBuckets = prometheus.ExponentialBuckets(0.01, 2, 14)
+
+// NewWorker creates a new worker for a query.
+func NewWorker(ctx context.Context, q *Query, c *Config) (*Worker, error) {
+	var tmpl *template.Template
+	if c.PayloadTemplate != "" {
+		var err error
+		if tmpl, err = newPayloadTemplate(c.PayloadTemplate); err != nil {
+			return nil, fmt.Errorf("Invalid payload-template: %s", err)
+		}
+	}
+
+	// Encode the payloads once for all subsequent requests.
+	payload, err := encodePayload(q, q.Driver, q.Connection, tmpl)
+	if err != nil {
+		return nil, err
+	}
+	payloads := [][]byte{payload}
+	headers := []map[string]string{q.acceptHeaders}
+	for _, ds := range q.fallbacks {
+		payload, err := encodePayload(q, ds.Driver, ds.Properties, tmpl)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, payload)
+		headers = append(headers, ds.AcceptHeaders)
+	}
+
+	userAgent := c.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent()
 	}
+
+	client, err := newAgentClient(c, q.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// The size of the primary payload, fallbacks only differ in the
+	// connection.
+	payloadBytes := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        fmt.Sprintf("query_result_%s_request_payload_bytes", q.Name),
+		Help:        "Size of the request payload of an SQL query",
+		ConstLabels: q.Labels,
+	})
+	payloadBytes.Set(float64(len(payloads[0])))
+
+	up := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        fmt.Sprintf("query_result_%s_up", q.Name),
+		Help:        "Whether the circuit breaker of an SQL query is closed",
+		ConstLabels: q.Labels,
+	})
+	up.Set(1)
+
+	result := NewQueryResult(q)
+	result.labelCase = c.LabelCase
+	result.labelSourceFile = c.LabelSourceFile
+	result.noDefaultPrefix = c.NoDefaultPrefix
+
+	var (
+		fetchDuration          prometheus.Gauge
+		fetchDurationHistogram prometheus.Histogram
+	)
+	durationName := fmt.Sprintf("query_result_%s_duration_seconds", q.Name)
+	if c.FetchDurationHistogram {
+		fetchDurationHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        durationName,
+			Help:        "Duration of successful fetches of an SQL query",
+			ConstLabels: q.Labels,
+			Buckets:     fetchDurationBuckets,
+		})
+	} else {
+		fetchDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        durationName,
+			Help:        "Duration of the last successful fetch of an SQL query",
+			ConstLabels: q.Labels,
+		})
+	}
+
+	return &Worker{
+		query:            q,
+		result:           result,
+		payloads:         payloads,
+		headers:          headers,
+		backoff:          defaultBackoff,
+		log:              result.log,
+		client:           client,
+		ctx:              ctx,
+		userAgent:        userAgent,
+		maxResponseBytes: c.MaxResponseBytes,
+		noInitialTick:    c.NoInitialTick,
+		consecutiveFailures: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        fmt.Sprintf("query_result_%s_consecutive_failures", q.Name),
+			Help:        "Number of consecutive failed fetches of an SQL query",
+			ConstLabels: q.Labels,
+		}),
+		fetchInProgress: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        fmt.Sprintf("query_result_%s_fetch_in_progress", q.Name),
+			Help:        "Whether a fetch of an SQL query is in progress",
+			ConstLabels: q.Labels,
+		}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        fmt.Sprintf("query_result_%s_panics_total", q.Name),
+			Help:        "Number of recovered panics while fetching an SQL query",
+			ConstLabels: q.Labels,
+		}),
+		heartbeat: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        fmt.Sprintf("query_result_%s_heartbeat", q.Name),
+			Help:        "Number of ticks of an SQL query, whether fetched successfully or not",
+			ConstLabels: q.Labels,
+		}),
+		payloadBytes: payloadBytes,
+		intervalSeconds: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        fmt.Sprintf("query_result_%s_interval_seconds", q.Name),
+			Help:        "Current interval between fetches of an SQL query, including jitter",
+			ConstLabels: q.Labels,
+		}),
+		lastError: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        fmt.Sprintf("query_result_%s_last_error", q.Name),
+			Help:        "Error of the last failed fetch of an SQL query, unset after a successful fetch",
+			ConstLabels: q.Labels,
+		}, []string{"error"}),
+		up: up,
+
+		fetchDuration:          fetchDuration,
+		fetchDurationHistogram: fetchDurationHistogram,
+	}, nil
 }
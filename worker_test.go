@@ -0,0 +1,951 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
+)
+
+func TestFetchCanceledDuringDecode(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	// Trickle an endless JSON array so the decode never finishes by itself.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("["))
+		for {
+			select {
+			case <-done:
+				return
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+				w.Write([]byte(`{"value": 1},`))
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := NewWorker(ctx, &Query{
+		Name:     "canceled_decode",
+		Interval: time.Minute,
+		Timeout:  time.Minute,
+	}, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := w.Fetch(ts.URL)
+		errc <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err != errCanceled {
+			t.Errorf("Fetch() error = %v, want %v", err, errCanceled)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Fetch() did not return after cancel")
+	}
+}
+
+func TestNewWorkerInvalidPayload(t *testing.T) {
+	_, err := NewWorker(context.Background(), &Query{
+		Name: "invalid_payload",
+		Params: map[string]interface{}{
+			// YAML decodes .nan which JSON can't encode.
+			"threshold": math.NaN(),
+		},
+	}, newConfig())
+	if err == nil {
+		t.Error("NewWorker() returned no error for an invalid payload")
+	}
+}
+
+func TestFetchInvalidURL(t *testing.T) {
+	w, err := NewWorker(context.Background(), &Query{
+		Name:     "invalid_url",
+		Interval: time.Minute,
+		Timeout:  time.Minute,
+	}, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Fetch("http://invalid host:5000"); err == nil {
+		t.Error("Fetch() returned no error for an invalid URL")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{header: "", want: 0},
+		{header: "120", want: 2 * time.Minute},
+		{header: "-1", want: 0},
+		{header: "Mon, 01 Jan 2018 12:00:30 GMT", want: 30 * time.Second},
+		{header: "Mon, 01 Jan 2018 11:00:00 GMT", want: 0},
+		{header: "soon", want: 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeWithColumns(t *testing.T) {
+	body := `[{"b": 1, "a": {"x": [1, 2]}, "count(*)": 3}, {"a": 2, "b": 3, "count(*)": 4}]`
+	recs, columns, err := decodeWithColumns(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("records = %v", recs)
+	}
+	if want := []string{"b", "a", "count(*)"}; !reflect.DeepEqual(columns, want) {
+		t.Errorf("columns = %v, want %v", columns, want)
+	}
+}
+
+func TestFetchLDJSON(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/x-ndjson; charset=utf-8")
+		w.Write([]byte("{\"name\": \"a\", \"value\": 1}\n{\"name\": \"b\", \"value\": 2}\n"))
+	}))
+	defer ts.Close()
+
+	w, err := NewWorker(context.Background(), &Query{
+		Name:      "ldjson",
+		Driver:    "mysql",
+		DataField: "value",
+		Interval:  time.Minute,
+		Timeout:   time.Minute,
+	}, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := w.Fetch(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[1]["name"] != "b" {
+		t.Errorf("records = %v", recs)
+	}
+	if _, _, err := decodeLDJSON(strings.NewReader("{\"a\": 1}\n[")); err == nil {
+		t.Error("expected an error for a truncated stream")
+	}
+}
+
+func TestEncodePayloadHints(t *testing.T) {
+	decode := func(q *Query) map[string]interface{} {
+		b, err := encodePayload(q, "postgresql", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	m := decode(&Query{Name: "plain", SQL: "select 1"})
+	if _, ok := m["read_only"]; ok {
+		t.Errorf("payload = %v, want no read_only", m)
+	}
+	if _, ok := m["isolation"]; ok {
+		t.Errorf("payload = %v, want no isolation", m)
+	}
+
+	m = decode(&Query{Name: "hinted", SQL: "select 1", ReadOnly: true, Isolation: IsolationSnapshot})
+	if m["read_only"] != true || m["isolation"] != IsolationSnapshot {
+		t.Errorf("payload = %v, want read_only and isolation", m)
+	}
+}
+
+func TestEncodePayloadTemplate(t *testing.T) {
+	tmpl, err := newPayloadTemplate(`{"query": {{json .sql}}, "datasource": {"driver": {{json .driver}}, "connection": {{json .connection}}}{{if .read_only}}, "readonly": true{{end}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := &Query{Name: "templated", SQL: "select 1", ReadOnly: true}
+	b, err := encodePayload(q, "mysql", map[string]interface{}{"host": "db"}, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"query": "select 1", "datasource": {"driver": "mysql", "connection": {"host":"db"}}, "readonly": true}`
+	if string(b) != want {
+		t.Errorf("payload = %s, want %s", b, want)
+	}
+
+	tmpl, _ = newPayloadTemplate(`{"query": {{.sql}}}`)
+	if _, err := encodePayload(q, "mysql", nil, tmpl); err == nil {
+		t.Error("expected an error for a payload that is not JSON")
+	}
+}
+
+func TestValueOnErrorRecord(t *testing.T) {
+	tests := []struct {
+		query *Query
+		key   string
+	}{
+		{&Query{Name: "error_default", DataField: "value"}, "error_default{}"},
+		{&Query{Name: "error_labels", DataField: "value", ErrorField: "value", ErrorLabels: map[string]string{"state": "unknown"}}, `error_labels{"state":"unknown"}`},
+	}
+	for _, tt := range tests {
+		tt.query.Driver = "mysql"
+		tt.query.ValueOnError = "-1"
+		tt.query.Interval = time.Minute
+		tt.query.Timeout = time.Minute
+		w, err := NewWorker(context.Background(), tt.query, newConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w.setValueOnError()
+		m, ok := w.result.Metrics()[tt.key]
+		if !ok {
+			t.Errorf("[%s] metrics = %v, want %s", tt.query.Name, w.result.Metrics(), tt.key)
+			w.unregisterMetrics()
+			continue
+		}
+		metric := &dto.Metric{}
+		m.Write(metric)
+		if v := metric.GetGauge().GetValue(); v != -1 {
+			t.Errorf("[%s] value = %v, want -1", tt.query.Name, v)
+		}
+		w.unregisterMetrics()
+	}
+
+	q := &Query{Name: "q", SQL: "select 1", DataField: "value", ErrorLabels: map[string]string{"state": "unknown"}}
+	if err := validateQuery(q, false); err == nil {
+		t.Error("expected an error for error-labels without error-field")
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"value": 1}, {"value": 2}, {"value": 3}, {"value": 4}]`))
+	}))
+	defer ts.Close()
+
+	c := newConfig()
+	c.MaxResponseBytes = 16
+	w, err := NewWorker(context.Background(), &Query{
+		Name:         "oversized",
+		DataField:    "value",
+		ValueOnError: "-1",
+		Interval:     time.Minute,
+		Timeout:      time.Minute,
+	}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.unregisterMetrics()
+
+	if _, err := w.Fetch(ts.URL); err != errResponseTooLarge {
+		t.Fatalf("Fetch() error = %v, want %v", err, errResponseTooLarge)
+	}
+	m, ok := w.result.Metrics()["oversized{}"]
+	if !ok {
+		t.Fatalf("metrics = %v, want the value-on-error", w.result.Metrics())
+	}
+	metric := &dto.Metric{}
+	m.Write(metric)
+	if v := metric.GetGauge().GetValue(); v != -1 {
+		t.Errorf("value = %v, want -1", v)
+	}
+}
+
+func TestFetchDecodeFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"value": 1}`))
+	}))
+	defer ts.Close()
+
+	w, err := NewWorker(context.Background(), &Query{
+		Name:     "malformed",
+		Driver:   "mysql",
+		Interval: time.Minute,
+		Timeout:  time.Minute,
+	}, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.unregisterMetrics()
+	w.attempts = 3
+
+	// A body that can't be decoded is a failed fetch like a failed request.
+	if _, err := w.Fetch(ts.URL); err == nil {
+		t.Fatal("expected an error for a malformed body")
+	}
+	metric := &dto.Metric{}
+	w.consecutiveFailures.Write(metric)
+	if v := metric.GetGauge().GetValue(); v != 1 {
+		t.Errorf("consecutive failures = %v, want 1", v)
+	}
+	if w.lastErr == "" {
+		t.Error("last error is empty")
+	}
+	if w.attempts != 3 {
+		t.Errorf("backoff attempts = %d, want 3 kept", w.attempts)
+	}
+}
+
+func TestRecordTransformer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"name": "a", "value": 1}, {"name": "b", "value": 2}]`))
+	}))
+	defer ts.Close()
+
+	w, err := NewWorker(context.Background(), &Query{
+		Name:      "transformed",
+		Driver:    "mysql",
+		DataField: "value",
+		Interval:  time.Minute,
+		Timeout:   time.Minute,
+	}, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.unregisterMetrics()
+
+	w.RecordTransformer = func(recs records) (records, error) {
+		return recs[1:], nil
+	}
+	recs, err := w.Fetch(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0]["name"] != "b" {
+		t.Errorf("records = %v, want only b", recs)
+	}
+	if _, ok := w.result.Metrics()[`transformed{"name":"b"}`]; !ok || len(w.result.Metrics()) != 1 {
+		t.Errorf("metrics = %v, want only b", w.result.Metrics())
+	}
+
+	w.RecordTransformer = func(recs records) (records, error) {
+		return nil, errors.New("bad pivot")
+	}
+	if _, err := w.Fetch(ts.URL); err == nil || !strings.Contains(err.Error(), "bad pivot") {
+		t.Errorf("Fetch() error = %v, want the transformer error", err)
+	}
+}
+
+func TestFetchAcceptHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("accept") != "text/csv" {
+			w.Header().Set("content-type", "application/json")
+			w.Write([]byte("[]"))
+			return
+		}
+		w.Header().Set("content-type", "text/csv; charset=utf-8")
+		w.Write([]byte("name,value\na,1\nb,2\n"))
+	}))
+	defer ts.Close()
+
+	w, err := NewWorker(context.Background(), &Query{
+		Name:          "csv",
+		Driver:        "mysql",
+		DataField:     "value",
+		Interval:      time.Minute,
+		Timeout:       time.Minute,
+		acceptHeaders: map[string]string{"Accept": "text/csv"},
+	}, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := w.Fetch(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[1]["name"] != "b" || recs[1]["value"] != "2" {
+		t.Errorf("records = %v", recs)
+	}
+	if _, _, err := decodeCSV(strings.NewReader("a,b\n1\n")); err == nil {
+		t.Error("expected an error for a short row")
+	}
+}
+
+func TestFetchUserAgent(t *testing.T) {
+	var userAgent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("user-agent")
+		w.Write([]byte("[]"))
+	}))
+	defer ts.Close()
+
+	for _, want := range []string{"", "custom/1.0"} {
+		c := newConfig()
+		c.UserAgent = want
+		w, err := NewWorker(context.Background(), &Query{
+			Name:      "user_agent",
+			Driver:    "mysql",
+			DataField: "value",
+			Interval:  time.Minute,
+			Timeout:   time.Minute,
+		}, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Fetch(ts.URL); err != nil {
+			t.Fatal(err)
+		}
+		w.unregisterMetrics()
+
+		if want == "" {
+			want = defaultUserAgent()
+		}
+		if userAgent != want {
+			t.Errorf("user-agent = %q, want %q", userAgent, want)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		mode     = "down"
+		requests int
+	)
+	setMode := func(m string) {
+		mu.Lock()
+		mode = m
+		mu.Unlock()
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		m := mode
+		requests++
+		mu.Unlock()
+		switch m {
+		case "down":
+			http.Error(w, "agent down", http.StatusInternalServerError)
+		case "malformed":
+			w.Write([]byte(`[{"value": 1}`))
+		default:
+			w.Write([]byte(`[{"value": 1}]`))
+		}
+	}))
+	defer ts.Close()
+
+	w, err := NewWorker(context.Background(), &Query{
+		Name:            "circuit",
+		Driver:          "mysql",
+		Interval:        50 * time.Millisecond,
+		Timeout:         time.Second,
+		CircuitFailures: 2,
+		CircuitCooldown: time.Hour,
+	}, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.unregisterMetrics()
+	w.backoff = backoff.Backoff{Min: time.Millisecond, Max: time.Millisecond}
+
+	up := func() float64 {
+		metric := &dto.Metric{}
+		w.up.Write(metric)
+		return metric.GetGauge().GetValue()
+	}
+	failures := func() float64 {
+		metric := &dto.Metric{}
+		w.consecutiveFailures.Write(metric)
+		return metric.GetGauge().GetValue()
+	}
+	if v := up(); v != 1 {
+		t.Errorf("up = %v before the first fetch, want 1", v)
+	}
+
+	// The retries of a tick count as one failed tick.
+	if _, err := w.Fetch(ts.URL); err == nil {
+		t.Fatal("expected the tick to fail")
+	}
+	mu.Lock()
+	retried := requests
+	mu.Unlock()
+	if w.circuitOpen() || up() != 1 || retried < 2 {
+		t.Fatalf("circuit open = %v, up = %v after one tick of %d requests", w.circuitOpen(), up(), retried)
+	}
+
+	if _, err := w.Fetch(ts.URL); err == nil {
+		t.Fatal("expected the circuit to open")
+	}
+	if !w.circuitOpen() || up() != 0 || w.failedTicks != 2 {
+		t.Fatalf("circuit open = %v, up = %v, failed ticks = %d", w.circuitOpen(), up(), w.failedTicks)
+	}
+	if v := failures(); v < float64(retried) {
+		t.Errorf("consecutive failures = %v, want every attempt", v)
+	}
+
+	// Half open after the cooldown, a failed probe opens it again. So does
+	// a response which can't be decoded.
+	w.circuitOpenUntil = time.Now()
+	if _, err := w.Fetch(ts.URL); err == nil || !w.circuitOpen() {
+		t.Fatalf("expected a failed probe to open the circuit, err = %v", err)
+	}
+	w.circuitOpenUntil = time.Now()
+	setMode("malformed")
+	if _, err := w.Fetch(ts.URL); err == nil || !w.circuitOpen() || up() != 0 {
+		t.Fatalf("circuit open = %v, up = %v after a malformed probe, err = %v", w.circuitOpen(), up(), err)
+	}
+
+	w.circuitOpenUntil = time.Now()
+	setMode("up")
+	if _, err := w.Fetch(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if w.circuitOpen() || up() != 1 {
+		t.Errorf("circuit open = %v, up = %v after a successful probe", w.circuitOpen(), up())
+	}
+	if v := failures(); v != 0 {
+		t.Errorf("consecutive failures = %v after a successful probe, want 0", v)
+	}
+}
+
+func TestCircuitOpenSweepsStale(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := NewWorker(ctx, &Query{
+		Name:            "circuit_stale",
+		DataField:       "value",
+		Interval:        time.Minute,
+		Timeout:         time.Second,
+		StaleAfter:      10 * time.Millisecond,
+		CircuitFailures: 1,
+	}, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetMetrics(records{record{"value": 1}})
+	if n := len(w.result.Metrics()); n != 1 {
+		t.Fatalf("%d metrics set, want 1", n)
+	}
+	w.circuitOpenUntil = time.Now().Add(time.Hour)
+	time.Sleep(20 * time.Millisecond)
+
+	// The tick skipped by the open circuit still expires the metric.
+	swept := make(chan struct{}, 1)
+	w.onFetch = func() { swept <- struct{}{} }
+	wg.Add(1)
+	go w.Start("http://agent.invalid/", wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	select {
+	case <-swept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tick did not run")
+	}
+	if n := len(w.result.Metrics()); n != 0 {
+		t.Errorf("%d metrics after stale-after with an open circuit, want 0", n)
+	}
+}
+
+func TestFetchDuration(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"value": 1}]`))
+	}))
+	defer ts.Close()
+
+	for _, histogram := range []bool{false, true} {
+		c := newConfig()
+		c.FetchDurationHistogram = histogram
+		w, err := NewWorker(context.Background(), &Query{
+			Name:     fmt.Sprintf("duration_%v", histogram),
+			Driver:   "mysql",
+			Interval: time.Minute,
+			Timeout:  time.Minute,
+		}, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Fetch(ts.URL); err != nil {
+			t.Fatal(err)
+		}
+
+		metric := &dto.Metric{}
+		if histogram {
+			w.fetchDurationHistogram.Write(metric)
+			if n := metric.GetHistogram().GetSampleCount(); n != 1 {
+				t.Errorf("histogram samples = %d, want 1", n)
+			}
+		} else {
+			w.fetchDuration.Write(metric)
+			if v := metric.GetGauge().GetValue(); v <= 0 {
+				t.Errorf("duration = %v, want > 0", v)
+			}
+		}
+	}
+}
+
+func TestAdaptInterval(t *testing.T) {
+	w := &Worker{
+		query: &Query{
+			Name:            "queue",
+			Interval:        time.Minute,
+			FastInterval:    time.Second,
+			SlowInterval:    time.Hour,
+			ThresholdColumn: "pending",
+		},
+		log:             log.New(ioutil.Discard, "", 0),
+		intervalSeconds: prometheus.NewGauge(prometheus.GaugeOpts{Name: "interval_seconds", Help: "Interval"}),
+	}
+	if d := w.interval(); d != time.Hour {
+		t.Errorf("initial interval = %s, want 1h", d)
+	}
+
+	w.adaptInterval(records{record{"queue": "a", "pending": 0}, record{"queue": "b", "Pending": "3"}})
+	if d := w.interval(); d != time.Second {
+		t.Errorf("interval = %s with pending rows, want 1s", d)
+	}
+	w.nextInterval()
+	metric := &dto.Metric{}
+	w.intervalSeconds.Write(metric)
+	if v := metric.GetGauge().GetValue(); v != 1 {
+		t.Errorf("interval seconds = %v, want 1", v)
+	}
+
+	w.adaptInterval(records{})
+	if d := w.interval(); d != time.Hour {
+		t.Errorf("interval = %s without rows, want 1h", d)
+	}
+
+	w.query.FastInterval = 0
+	if d := w.interval(); d != time.Minute {
+		t.Errorf("static interval = %s, want 1m", d)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if d := jitter(time.Minute, 0); d != time.Minute {
+		t.Errorf("jitter() without percentage = %s, want 1m", d)
+	}
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Minute, 10)
+		if d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("jitter() = %s, want within 10%% of 1m", d)
+		}
+	}
+}
+
+func TestResetBackoff(t *testing.T) {
+	for _, tt := range []struct {
+		reset string
+		want  time.Duration
+	}{
+		{reset: "", want: time.Second},
+		{reset: BackoffResetSoft, want: 8 * time.Second}, // Half of the next 16s
+	} {
+		w := &Worker{
+			query:   &Query{Name: "backoff", BackoffReset: tt.reset},
+			backoff: backoff.Backoff{Min: time.Second, Max: time.Minute, Factor: 2},
+		}
+		for i := 0; i < 4; i++ {
+			w.backoffDuration()
+		}
+		w.resetBackoff()
+		if d := w.backoffDuration(); d != tt.want {
+			t.Errorf("[%s] backoff after reset = %s, want %s", tt.reset, d, tt.want)
+		}
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	if tr := newTransport("", nil); tr != nil {
+		t.Errorf("newTransport() = %v, want the default transport", tr)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: newTransport(AgentProtocolHTTP1, nil)}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	client = &http.Client{Transport: newTransport(AgentProtocolHTTP2, nil)}
+	if _, err := client.Get(ts.URL); err == nil || !strings.Contains(err.Error(), "HTTP/2") {
+		t.Errorf("expected an error for an HTTP/1.1 response, got %v", err)
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{"application/json", `{"message": "syntax error", "code": 1064}`, "syntax error (code 1064)"},
+		{"application/problem+json; charset=utf-8", `{"message": "timeout"}`, "timeout"},
+		{"application/json", `{"error": "unknown"}`, `{"error": "unknown"}`},
+		{"application/json", `not json`, "not json"},
+		{"text/plain", `{"message": "syntax error"}`, `{"message": "syntax error"}`},
+	}
+	for _, tt := range tests {
+		if got := errorMessage(tt.contentType, []byte(tt.body)); got != tt.want {
+			t.Errorf("errorMessage(%q, %q) = %q, want %q", tt.contentType, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	proxied := false
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.Host == "agent.invalid"
+		w.Write([]byte("[]"))
+	}))
+	defer proxy.Close()
+
+	c := newConfig()
+	c.ProxyURL = proxy.URL
+	w, err := NewWorker(context.Background(), &Query{
+		Name:     "proxied",
+		Driver:   "mysql",
+		Interval: time.Minute,
+		Timeout:  time.Minute,
+	}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Fetch("http://agent.invalid/"); err != nil {
+		t.Fatal(err)
+	}
+	if !proxied {
+		t.Error("request was not sent through the proxy")
+	}
+}
+
+func TestLastError(t *testing.T) {
+	body := `not json`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	w, err := NewWorker(context.Background(), &Query{
+		Name:     "last_error",
+		Driver:   "mysql",
+		Interval: time.Minute,
+		Timeout:  time.Minute,
+	}, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Fetch(ts.URL); err == nil {
+		t.Fatal("expected a decode error")
+	}
+	metric := &dto.Metric{}
+	w.lastError.WithLabelValues(w.lastErr).Write(metric)
+	if w.lastErr == "" || metric.GetGauge().GetValue() != 1 {
+		t.Errorf("last error = %q, value %v", w.lastErr, metric.GetGauge().GetValue())
+	}
+
+	body = `[{"value": 1}]`
+	if _, err := w.Fetch(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if w.lastErr != "" {
+		t.Errorf("last error = %q after a successful fetch", w.lastErr)
+	}
+	ch := make(chan prometheus.Metric, 1)
+	w.lastError.Collect(ch)
+	if len(ch) != 0 {
+		t.Error("last error metric not cleared after a successful fetch")
+	}
+}
+
+func TestFetchFallback(t *testing.T) {
+	var drivers []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct{ Driver string }
+		json.NewDecoder(r.Body).Decode(&payload)
+		drivers = append(drivers, payload.Driver)
+		if payload.Driver == "mysql" {
+			http.Error(w, "primary down", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`[{"value": 1}]`))
+	}))
+	defer ts.Close()
+
+	w, err := NewWorker(context.Background(), &Query{
+		Name:         "fallback",
+		Driver:       "mysql",
+		Interval:     time.Minute,
+		Timeout:      time.Minute,
+		FallbackRefs: []string{"secondary"},
+		fallbacks:    []DataSource{{Driver: "postgresql"}},
+	}, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Fetch(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"mysql", "postgresql"}; !reflect.DeepEqual(drivers, want) {
+		t.Errorf("drivers = %v, want %v", drivers, want)
+	}
+	if w.failures != 0 {
+		t.Errorf("failures = %d, want 0", w.failures)
+	}
+}
+
+func TestFetchInProgress(t *testing.T) {
+	var w *Worker
+	var during float64
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		metric := &dto.Metric{}
+		w.fetchInProgress.Write(metric)
+		during = metric.GetGauge().GetValue()
+		rw.Write([]byte(`[{"value": 1}]`))
+	}))
+	defer ts.Close()
+
+	w, err := NewWorker(context.Background(), &Query{
+		Name:     "in_progress",
+		Interval: time.Minute,
+		Timeout:  time.Minute,
+	}, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Fetch(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	metric := &dto.Metric{}
+	w.fetchInProgress.Write(metric)
+	if during != 1 || metric.GetGauge().GetValue() != 0 {
+		t.Errorf("fetch in progress = %v during and %v after fetch, want 1 and 0", during, metric.GetGauge().GetValue())
+	}
+}
+
+func TestStartRecoversPanic(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"value": 1}]`))
+	}))
+	defer ts.Close()
+
+	wg := new(sync.WaitGroup)
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := NewWorker(ctx, &Query{
+		Name:     "panicking",
+		Interval: time.Minute,
+		Timeout:  time.Minute,
+	}, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched := make(chan struct{})
+	w.onFirstFetch = func() {
+		close(fetched)
+		panic("boom")
+	}
+
+	wg.Add(1)
+	go w.Start(ts.URL, wg)
+	<-fetched
+	cancel()
+	wg.Wait()
+
+	metric := &dto.Metric{}
+	w.panics.Write(metric)
+	if v := metric.GetCounter().GetValue(); v != 1 {
+		t.Errorf("panics = %v, want 1", v)
+	}
+	w.heartbeat.Write(metric)
+	if v := metric.GetCounter().GetValue(); v != 1 {
+		t.Errorf("heartbeat = %v, want 1", v)
+	}
+}
+
+func TestStartNoInitialTick(t *testing.T) {
+	requests := make(chan time.Time, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- time.Now()
+		w.Write([]byte(`[{"value": 1}]`))
+	}))
+	defer ts.Close()
+
+	c := newConfig()
+	c.NoInitialTick = true
+	wg := new(sync.WaitGroup)
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := NewWorker(ctx, &Query{
+		Name:     "no_initial_tick",
+		Interval: 200 * time.Millisecond,
+		Timeout:  100 * time.Millisecond,
+	}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	wg.Add(1)
+	go w.Start(ts.URL, wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	select {
+	case at := <-requests:
+		if d := at.Sub(start); d < 200*time.Millisecond {
+			t.Errorf("first fetch after %s, want one interval", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query was not fetched")
+	}
+}
+
+func TestPayloadBytes(t *testing.T) {
+	w, err := NewWorker(context.Background(), &Query{
+		Name: "payload_size",
+		SQL:  "select 1",
+	}, newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metric := &dto.Metric{}
+	w.payloadBytes.Write(metric)
+	if v := metric.GetGauge().GetValue(); v != float64(len(w.payloads[0])) || v == 0 {
+		t.Errorf("payload bytes = %v, want %d", v, len(w.payloads[0]))
+	}
+}